@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envPrefix = "IRWYS_"
+	// configFlag is the flag naming the config file.
+	configFlag = "config"
+	// tokenKey is the key of the bot's token in the config file.
+	tokenKey = "token"
+)
+
+// envName returns the environment variable a flag is read from, e.g. IRWYS_MIN_WORDS for minWords.
+func envName(flag string) string {
+	b := strings.Builder{}
+	b.WriteString(envPrefix)
+	for i, r := range flag {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// configPath finds the config file named on the command line or in the environment.
+// It's needed before the command line is parsed, as the file provides defaults of flags.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+configFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--"+configFlag+"=") {
+			return strings.TrimPrefix(arg, "--"+configFlag+"=")
+		}
+	}
+	return os.Getenv(envName(configFlag))
+}
+
+// loadConfig reads a config file mapping flag names to values.
+// Files with the .toml extension are TOML, others are YAML.
+func loadConfig(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", path, err)
+	}
+
+	values := map[string]string{}
+	for key, value := range raw {
+		switch value.(type) {
+		case string, bool, int, int64, uint64, float64:
+			values[key] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: value of %s must be a string, number or boolean", path, key)
+		}
+	}
+	return values, nil
+}
+
+// configure binds flags of the application to environment variables
+// and makes values of the config file their defaults,
+// so a flag overrides the environment, which overrides the file, which overrides built-in defaults.
+// The token, unlike flags, may be given in the file under the token key.
+func configure(app *kingpin.Application, token *kingpin.ArgClause, values map[string]string) error {
+	for _, f := range app.Model().Flags {
+		if f.Hidden || f.Name == "help" {
+			continue
+		}
+		app.GetFlag(f.Name).Envar(envName(f.Name))
+	}
+	token.Envar(envName(tokenKey))
+
+	for key, value := range values {
+		switch key {
+		case tokenKey:
+			token.Default(value)
+			continue
+		case configFlag:
+			return fmt.Errorf("config file can't name another config file")
+		}
+		f := app.GetFlag(key)
+		if f == nil {
+			return fmt.Errorf("unknown option %q in config file", key)
+		}
+		f.Default(value)
+	}
+	return nil
+}
+
+// flagDefaults returns built-in defaults of flags of the application by flag name.
+func flagDefaults(app *kingpin.Application) map[string][]string {
+	defaults := map[string][]string{}
+	for _, f := range app.Model().Flags {
+		defaults[f.Name] = f.Default
+	}
+	return defaults
+}
+
+// reconfigure reads the config file at path, if any, and parses args again, as on start.
+// Flags the file doesn't set anymore get their built-in defaults back.
+func reconfigure(
+	app *kingpin.Application,
+	token *kingpin.ArgClause,
+	defaults map[string][]string,
+	path string,
+	args []string,
+) error {
+	var values map[string]string
+	if path != "" {
+		var err error
+		if values, err = loadConfig(path); err != nil {
+			return err
+		}
+	}
+	for name, value := range defaults {
+		app.GetFlag(name).Default(value...)
+	}
+	if err := configure(app, token, values); err != nil {
+		return err
+	}
+	_, err := app.Parse(args)
+	return err
+}
+
+// readToken returns the token kept in the file.
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestEnvName(t *testing.T) {
+	for flag, want := range map[string]string{
+		"minWords":      "IRWYS_MIN_WORDS",
+		"dbPath":        "IRWYS_DB_PATH",
+		"webhookSecret": "IRWYS_WEBHOOK_SECRET",
+		"verbose":       "IRWYS_VERBOSE",
+	} {
+		if got := envName(flag); got != want {
+			t.Errorf("envName(%q) = %q, want %q", flag, got, want)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "irwys.yml")
+	data := "minWords: 3\nmaxWords: 30\ntimeout: 15\nverbose: true\ntoken: from-file\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("IRWYS_MAX_WORDS", "40")
+	t.Setenv("IRWYS_TIMEOUT", "20")
+
+	app := kingpin.New("irwys", "")
+	minWords := app.Flag("minWords", "").Default("25").Uint16()
+	maxWords := app.Flag("maxWords", "").Default("100").Uint16()
+	timeout := app.Flag("timeout", "").Default("30").Int16()
+	capacity := app.Flag("capacity", "").Default("2048").Uint16()
+	verbose := app.Flag("verbose", "").Bool()
+	tokenArg := app.Arg("token", "")
+	token := tokenArg.String()
+
+	args := []string{"--config", path, "--timeout", "10"}
+	if got := configPath(args); got != path {
+		t.Fatalf("configPath = %q, want %q", got, path)
+	}
+	app.Flag(configFlag, "").String()
+	values, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configure(app, tokenArg, values); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	// File over default, environment over file, flag over environment.
+	if *minWords != 3 || *maxWords != 40 || *timeout != 10 || *capacity != 2048 || !*verbose {
+		t.Fatalf("Got minWords=%d maxWords=%d timeout=%d capacity=%d verbose=%t",
+			*minWords, *maxWords, *timeout, *capacity, *verbose)
+	}
+	if *token != "from-file" {
+		t.Fatalf("Got token %q, want from-file", *token)
+	}
+}
+
+func TestConfigRejectsUnknownOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "irwys.toml")
+	if err := ioutil.WriteFile(path, []byte("minWord = 3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := kingpin.New("irwys", "")
+	app.Flag("minWords", "").Default("25").Uint16()
+	values, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configure(app, app.Arg("token", ""), values); err == nil {
+		t.Fatal("Unknown option was accepted")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "irwys.yml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := kingpin.New("irwys", "")
+	minWords := app.Flag("minWords", "").Default("25").Uint16()
+	maxWords := app.Flag("maxWords", "").Default("100").Uint16()
+	timeout := app.Flag("timeout", "").Default("30").Int16()
+	app.Flag(configFlag, "").String()
+	tokenArg := app.Arg("token", "")
+	tokenArg.String()
+	defaults := flagDefaults(app)
+	args := []string{"--config", path, "--timeout", "10"}
+
+	write("minWords: 3\nmaxWords: 30\n")
+	if err := reconfigure(app, tokenArg, defaults, path, args); err != nil {
+		t.Fatal(err)
+	}
+	if *minWords != 3 || *maxWords != 30 || *timeout != 10 {
+		t.Fatalf("Got minWords=%d maxWords=%d timeout=%d", *minWords, *maxWords, *timeout)
+	}
+
+	// Options dropped from the file get built-in defaults back, flags still win.
+	write("minWords: 5\ntimeout: 20\n")
+	if err := reconfigure(app, tokenArg, defaults, path, args); err != nil {
+		t.Fatal(err)
+	}
+	if *minWords != 5 || *maxWords != 100 || *timeout != 10 {
+		t.Fatalf("Got minWords=%d maxWords=%d timeout=%d after reconfiguring", *minWords, *maxWords, *timeout)
+	}
+
+	write("minWords: [1, 2]\n")
+	if err := reconfigure(app, tokenArg, defaults, path, args); err == nil {
+		t.Fatal("Reconfigured with an invalid file")
+	}
+}
@@ -0,0 +1,237 @@
+package irwys
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const adminTimeLayout = "2006-01-02 15:04"
+
+// ChatSummary describes what the bot keeps for a chat.
+type ChatSummary struct {
+	ID       int64
+	Config   ChatConfig
+	Started  bool
+	Messages int
+	// Oldest and Newest are dates of remembered messages, zero if unknown.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Summarize describes what the bot keeps for the chat.
+func Summarize(store Store, chatID int64) (sum ChatSummary, err error) {
+	sum.ID = chatID
+	if sum.Config, sum.Started, err = store.Chats().Get(chatID); err != nil {
+		return
+	}
+	refs, err := store.Messages().Get(chatID)
+	if err != nil {
+		return
+	}
+
+	sum.Messages = len(refs)
+	for _, ref := range refs {
+		if ref.Date == 0 {
+			continue
+		}
+		if sum.Oldest.IsZero() || ref.Time().Before(sum.Oldest) {
+			sum.Oldest = ref.Time()
+		}
+		if ref.Time().After(sum.Newest) {
+			sum.Newest = ref.Time()
+		}
+	}
+
+	return
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(adminTimeLayout)
+}
+
+// knownChats returns identifiers of chats the bot is started in or remembers messages of.
+func knownChats(store Store) ([]int64, error) {
+	started, err := store.Chats().IDs()
+	if err != nil {
+		return nil, err
+	}
+	remembered, err := store.Messages().IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[int64]bool{}
+	ids := []int64{}
+	for _, id := range append(started, remembered...) {
+		if !known[id] {
+			known[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// WriteChats writes a table of chats the bot is started in or remembers messages of to w.
+// Chats the bot isn't started in are marked with an asterisk.
+func WriteChats(store Store, w io.Writer) error {
+	ids, err := knownChats(store)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHAT\tLANGUAGE\tSTRATEGY\tMESSAGES\tNEWEST\tLAST RECALL")
+	for _, id := range ids {
+		sum, err := Summarize(store, id)
+		if err != nil {
+			return err
+		}
+		chat := strconv.FormatInt(id, 10)
+		if !sum.Started {
+			chat += "*"
+		}
+		lang, strategy := sum.Config.Language, sum.Config.Strategy
+		if lang == "" {
+			lang = "-"
+		}
+		if strategy == "" {
+			strategy = "-"
+		}
+		var recall time.Time
+		if sum.Config.Recalls.Last > 0 {
+			recall = time.Unix(sum.Config.Recalls.Last, 0)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			chat, lang, strategy, sum.Messages, formatTime(sum.Newest), formatTime(recall))
+	}
+	return tw.Flush()
+}
+
+// WriteChat writes details of the chat to w, including its effective settings.
+func WriteChat(store Store, chatID int64, opts *Options, w io.Writer) error {
+	sum, err := Summarize(store, chatID)
+	if err != nil {
+		return err
+	}
+	if !sum.Started && sum.Messages == 0 {
+		return fmt.Errorf("chat %d is unknown", chatID)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Chat:\t%d\n", sum.ID)
+	fmt.Fprintf(tw, "Started:\t%t\n", sum.Started)
+	fmt.Fprintf(tw, "Messages:\t%d\n", sum.Messages)
+	fmt.Fprintf(tw, "Oldest:\t%s\n", formatTime(sum.Oldest))
+	fmt.Fprintf(tw, "Newest:\t%s\n", formatTime(sum.Newest))
+	if sum.Started {
+		s := opts.settingsOf(sum.Config)
+		fmt.Fprintf(tw, "Language:\t%s\n", sum.Config.Language)
+		fmt.Fprintf(tw, "Time zone:\t%s\n", s.Location)
+		fmt.Fprintf(tw, "Strategy:\t%s\n", s.Strategy)
+		for _, def := range settingDefs {
+			line := fmt.Sprintf("%s:\t%d", def.name, *def.field(&s))
+			if _, ok := sum.Config.Settings[def.name]; !ok {
+				line += " (default)"
+			}
+			fmt.Fprintln(tw, line)
+		}
+		fmt.Fprintf(tw, "Recalls today:\t%d\n", sum.Config.Recalls.today(time.Now(), s.Location))
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	if sum.Started {
+		data, err := json.MarshalIndent(sum.Config, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\nRecord:\n%s\n", data)
+	}
+	return nil
+}
+
+// Purge forgets messages of the chat posted before the given time.
+// Messages of unknown date are kept. Returns the number of forgotten messages.
+func Purge(store Store, chatID int64, before time.Time) (int, error) {
+	refs, err := store.Messages().Get(chatID)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := []MessageRef{}
+	for _, ref := range refs {
+		if ref.Date == 0 || !ref.Time().Before(before) {
+			kept = append(kept, ref)
+		}
+	}
+	if len(kept) == len(refs) {
+		return 0, nil
+	}
+	return len(refs) - len(kept), store.Messages().Put(chatID, kept)
+}
+
+// Compact reclaims space of deleted records, if the backend supports it.
+func Compact(store Store) error {
+	c, ok := store.(compacter)
+	if !ok {
+		return fmt.Errorf("storage can't be compacted")
+	}
+	return c.Compact()
+}
+
+// Stats returns figures describing the storage: numbers of started chats and remembered messages,
+// followed by ones specific to the backend.
+func Stats(store Store) ([]StoreStat, error) {
+	counts, err := store.Messages().Counts()
+	if err != nil {
+		return nil, err
+	}
+	return storeStats(store, counts)
+}
+
+// storeStats returns figures describing the storage, which has counts of messages per chat.
+func storeStats(store Store, counts map[int64]int) ([]StoreStat, error) {
+	ids, err := store.Chats().IDs()
+	if err != nil {
+		return nil, err
+	}
+	var messages int64
+	for _, n := range counts {
+		messages += int64(n)
+	}
+	stats := []StoreStat{{"chats", int64(len(ids))}, {"messages", messages}}
+
+	if s, ok := store.(statter); ok {
+		backend, err := s.Stats()
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(backend, func(i, j int) bool { return backend[i].Name < backend[j].Name })
+		stats = append(stats, backend...)
+	}
+	return stats, nil
+}
+
+// WriteStats writes figures describing the storage to w.
+func WriteStats(store Store, w io.Writer) error {
+	stats, err := Stats(store)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%d\n", s.Name, s.Value)
+	}
+	return tw.Flush()
+}
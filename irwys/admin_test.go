@@ -0,0 +1,65 @@
+package irwys
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminCommands(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Store) {
+		opts := testOptions()
+		day := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.Local)
+
+		store.Chats().Put(-3, ChatConfig{Language: "ru", Strategy: "older", Settings: map[string]int{"timeout": 5}})
+		store.Messages().Put(-3, []MessageRef{
+			{ID: 1, Date: day.AddDate(0, 0, -2).Unix()},
+			{ID: 2},
+			{ID: 3, Date: day.Unix()},
+		})
+		store.Messages().Put(7, []MessageRef{{ID: 1, Date: day.Unix()}})
+
+		out := new(bytes.Buffer)
+		if err := WriteChats(store, out); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[1], "-3 ") || !strings.HasPrefix(lines[2], "7* ") ||
+			!strings.Contains(lines[1], "older") {
+			t.Fatalf("Unexpected chat list:\n%s", out)
+		}
+
+		out.Reset()
+		if err := WriteChat(store, -3, &opts, out); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"Messages:", "timeout:", "minWords:", "(default)", `"language": "ru"`} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Chat details lack %q:\n%s", want, out)
+			}
+		}
+		if err := WriteChat(store, 8, &opts, out); err == nil {
+			t.Error("Showed unknown chat")
+		}
+
+		if n, err := Purge(store, -3, day.AddDate(0, 0, -1)); err != nil || n != 1 {
+			t.Fatalf("Purged %d messages (%v), want 1", n, err)
+		}
+		if refs, _ := store.Messages().Get(-3); !reflect.DeepEqual(ids(refs), []int{2, 3}) {
+			t.Fatalf("Got messages %v after purge, want [2 3]", ids(refs))
+		}
+
+		if err := Compact(store); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := Stats(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) < 3 || stats[0] != (StoreStat{"chats", 1}) || stats[1] != (StoreStat{"messages", 3}) {
+			t.Fatalf("Unexpected stats %v", stats)
+		}
+	})
+}
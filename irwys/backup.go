@@ -0,0 +1,302 @@
+package irwys
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of backup records.
+const (
+	backupChat    = "chat"
+	backupMessage = "message"
+)
+
+// maxBackupLine limits the size of a backup record.
+const maxBackupLine = 1 << 20
+
+// backupRecord is a line of a chat backup.
+// A backup starts with the chat record, if the chat is started, followed by its messages oldest first.
+type backupRecord struct {
+	Kind    string      `json:"kind"`
+	ChatID  int64       `json:"chat_id"`
+	Config  *ChatConfig `json:"config,omitempty"`
+	Message *MessageRef `json:"message,omitempty"`
+}
+
+// Export writes configuration and remembered messages of the chat to w as JSON lines.
+// Returns the number of exported messages.
+func Export(store Store, chatID int64, w io.Writer) (n int, err error) {
+	conf, ok, err := store.Chats().Get(chatID)
+	if err != nil {
+		return
+	}
+	refs, err := store.Messages().Get(chatID)
+	if err != nil {
+		return
+	}
+	if !ok && len(refs) == 0 {
+		return 0, fmt.Errorf("chat %d is unknown", chatID)
+	}
+
+	enc := json.NewEncoder(w)
+	if ok {
+		if err = enc.Encode(backupRecord{Kind: backupChat, ChatID: chatID, Config: &conf}); err != nil {
+			return
+		}
+	}
+	for i := range refs {
+		if err = enc.Encode(backupRecord{Kind: backupMessage, ChatID: chatID, Message: &refs[i]}); err != nil {
+			return
+		}
+		n++
+	}
+
+	return
+}
+
+// Import loads chats exported by Export from r.
+// Chat configurations are replaced, messages are merged with the ones already remembered.
+// Returns the number of imported messages.
+func Import(store Store, r io.Reader, opts *Options) (n int, err error) {
+	order := []int64{}
+	confs := map[int64]*ChatConfig{}
+	messages := map[int64][]MessageRef{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBackupLine)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var rec backupRecord
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return 0, fmt.Errorf("line %d: %s", line, err)
+		}
+		if _, ok := messages[rec.ChatID]; !ok {
+			order = append(order, rec.ChatID)
+			messages[rec.ChatID] = []MessageRef{}
+		}
+		switch {
+		case rec.Kind == backupChat && rec.Config != nil:
+			confs[rec.ChatID] = rec.Config
+		case rec.Kind == backupMessage && rec.Message != nil:
+			messages[rec.ChatID] = append(messages[rec.ChatID], *rec.Message)
+		default:
+			return 0, fmt.Errorf("line %d: malformed %q record", line, rec.Kind)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	for _, chatID := range order {
+		if conf := confs[chatID]; conf != nil {
+			if err = store.Chats().Put(chatID, *conf); err != nil {
+				return
+			}
+		}
+		if err = mergeMessages(store, chatID, messages[chatID], opts); err != nil {
+			return
+		}
+		n += len(messages[chatID])
+	}
+
+	return
+}
+
+// mergeMessages adds messages to the ones the chat remembers, skipping known ones.
+// Messages are ordered by date and the oldest are dropped to fit the chat's capacity.
+func mergeMessages(store Store, chatID int64, refs []MessageRef, opts *Options) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	conf, _, err := store.Chats().Get(chatID)
+	if err != nil {
+		return err
+	}
+	capacity := opts.settingsOf(conf).Capacity
+
+	merged, err := store.Messages().Get(chatID)
+	if err != nil {
+		return err
+	}
+	known := map[int]bool{}
+	for _, ref := range merged {
+		known[ref.ID] = true
+	}
+	for _, ref := range refs {
+		if !known[ref.ID] {
+			known[ref.ID] = true
+			merged = append(merged, ref)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Date < merged[j].Date })
+	if len(merged) > capacity {
+		merged = merged[len(merged)-capacity:]
+	}
+	return store.Messages().Put(chatID, merged)
+}
+
+// telegramExport is a chat history exported by Telegram Desktop in JSON format.
+type telegramExport struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	ID       int64             `json:"id"`
+	Messages []telegramMessage `json:"messages"`
+}
+
+type telegramMessage struct {
+	ID           int             `json:"id"`
+	Type         string          `json:"type"`
+	Date         string          `json:"date"`
+	DateUnixtime string          `json:"date_unixtime"`
+	From         string          `json:"from"`
+	FromID       string          `json:"from_id"`
+	Text         json.RawMessage `json:"text"`
+	ReplyToID    int             `json:"reply_to_message_id"`
+	Photo        string          `json:"photo"`
+	File         string          `json:"file"`
+	MediaType    string          `json:"media_type"`
+}
+
+// Message types of Telegram Desktop exports.
+var telegramMediaTypes = map[string]string{
+	"animation":     messageAnimation,
+	"audio_file":    messageAudio,
+	"sticker":       messageSticker,
+	"video_file":    messageVideo,
+	"video_message": messageVideo,
+	"voice_message": messageVoice,
+}
+
+// chatID converts the identifier of the exported chat to the one used by the Bot API.
+func (e telegramExport) chatID() int64 {
+	switch {
+	case strings.HasSuffix(e.Type, "_supergroup"), strings.HasSuffix(e.Type, "_channel"):
+		return -1000000000000 - e.ID
+	case e.Type == "private_group":
+		return -e.ID
+	}
+	return e.ID
+}
+
+// ImportTelegram loads messages of a chat history exported by Telegram Desktop (result.json) from r,
+// so they can be recalled as if the bot remembered them.
+// Messages are imported into chatID, or the exported chat if it's 0.
+// They are filtered by length like the ones the bot remembers itself.
+// Exported media can't be posted again, so only messages still in the chat can be recalled with them.
+// Returns the chat messages were imported into and their number.
+func ImportTelegram(store Store, r io.Reader, chatID int64, opts *Options) (int64, int, error) {
+	var export telegramExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return 0, 0, err
+	}
+	if chatID == 0 {
+		chatID = export.chatID()
+	}
+	if chatID == 0 {
+		return 0, 0, fmt.Errorf("chat of the export is unknown")
+	}
+
+	conf, _, err := store.Chats().Get(chatID)
+	if err != nil {
+		return chatID, 0, err
+	}
+	settings := opts.settingsOf(conf)
+
+	refs := []MessageRef{}
+	for _, msg := range export.Messages {
+		if msg.Type != "message" {
+			continue
+		}
+		ref, err := msg.ref()
+		if err != nil {
+			return chatID, 0, fmt.Errorf("message %d: %s", msg.ID, err)
+		}
+		if worthRemembering(settings, ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	return chatID, len(refs), mergeMessages(store, chatID, refs, opts)
+}
+
+func (msg telegramMessage) ref() (ref MessageRef, err error) {
+	ref = MessageRef{
+		ID:         msg.ID,
+		AuthorName: msg.From,
+		Type:       messageText,
+		ReplyToID:  msg.ReplyToID,
+	}
+	if strings.HasPrefix(msg.FromID, "user") {
+		ref.AuthorID, _ = strconv.Atoi(strings.TrimPrefix(msg.FromID, "user"))
+	}
+
+	if msg.DateUnixtime != "" {
+		ref.Date, err = strconv.ParseInt(msg.DateUnixtime, 10, 64)
+	} else {
+		var t time.Time
+		t, err = time.ParseInLocation("2006-01-02T15:04:05", msg.Date, time.Local)
+		ref.Date = t.Unix()
+	}
+	if err != nil {
+		return
+	}
+
+	if ref.Text, err = telegramText(msg.Text); err != nil {
+		return
+	}
+
+	switch {
+	case msg.Photo != "":
+		ref.Type = messagePhoto
+	case telegramMediaTypes[msg.MediaType] != "":
+		ref.Type = telegramMediaTypes[msg.MediaType]
+	case msg.File != "":
+		ref.Type = messageDocument
+	}
+
+	return
+}
+
+// telegramText flattens exported text, which is either a string
+// or a list of strings and formatted entities.
+func telegramText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", err
+	}
+	b := strings.Builder{}
+	for _, part := range parts {
+		if err := json.Unmarshal(part, &s); err == nil {
+			b.WriteString(s)
+			continue
+		}
+		var entity struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(part, &entity); err != nil {
+			return "", err
+		}
+		b.WriteString(entity.Text)
+	}
+	return b.String(), nil
+}
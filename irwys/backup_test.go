@@ -0,0 +1,105 @@
+package irwys
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testOptions() Options {
+	return Options{
+		MinWords: 2, MaxWords: 100, Timeout: 600, TimeStart: 9, TimeEnd: 23, Capacity: 4, Probability: 30,
+		Strategy: "uniform", Storage: MemoryStorage, ReplyPath: "../replies", Language: "en",
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	opts := testOptions()
+
+	src := NewMemoryStore()
+	defer src.Close()
+	conf := ChatConfig{Language: "ru", Timezone: "Europe/Moscow", Settings: map[string]int{"capacity": 3}}
+	src.Chats().Put(-5, conf)
+	src.Messages().Put(-5, []MessageRef{
+		{ID: 1, Date: 100, Type: messageText, Text: "first"},
+		{ID: 2, Date: 200, Type: messagePhoto, FileIDs: []string{"a", "b"}, Replies: 2},
+	})
+
+	if _, err := Export(src, -6, ioutil.Discard); err == nil {
+		t.Fatal("Exported unknown chat")
+	}
+	backup := new(bytes.Buffer)
+	if n, err := Export(src, -5, backup); err != nil || n != 2 {
+		t.Fatalf("Exported %d messages (%v), want 2", n, err)
+	}
+
+	dst := NewMemoryStore()
+	defer dst.Close()
+	dst.Messages().Put(-5, []MessageRef{{ID: 2, Date: 200}, {ID: 3, Date: 300}, {ID: 4, Date: 400}})
+	if n, err := Import(dst, backup, &opts); err != nil || n != 2 {
+		t.Fatalf("Imported %d messages (%v), want 2", n, err)
+	}
+
+	if got, ok, _ := dst.Chats().Get(-5); !ok || !reflect.DeepEqual(got, conf) {
+		t.Fatalf("Imported config %+v, want %+v", got, conf)
+	}
+	// Known messages are kept, and the oldest dropped to fit the capacity of the imported chat.
+	refs, _ := dst.Messages().Get(-5)
+	if !reflect.DeepEqual(ids(refs), []int{2, 3, 4}) || refs[0].Replies != 0 {
+		t.Fatalf("Got messages %+v, want [2 3 4] with 2 not replaced", refs)
+	}
+
+	if _, err := Import(dst, strings.NewReader(`{"kind":"chat","chat_id":1}`), &opts); err == nil {
+		t.Fatal("Imported chat record without config")
+	}
+}
+
+const telegramHistory = `{
+	"name": "Old friends",
+	"type": "private_supergroup",
+	"id": 1234567890,
+	"messages": [
+		{"id": 1, "type": "service", "date": "2019-05-01T10:00:00", "actor": "Test", "action": "create_channel", "text": ""},
+		{
+			"id": 2, "type": "message", "date": "2019-05-01T10:01:00", "date_unixtime": "1556704860",
+			"from": "Test User", "from_id": "user42", "text": "remember the first meeting"
+		},
+		{
+			"id": 3, "type": "message", "date": "2019-05-01T10:02:00", "date_unixtime": "1556704920",
+			"from": "Other", "from_id": "user43", "reply_to_message_id": 2,
+			"text": ["it was ", {"type": "bold", "text": "great"}, " indeed"]
+		},
+		{"id": 4, "type": "message", "date": "2019-05-01T10:03:00", "date_unixtime": "1556704980", "from": "Other", "from_id": "user43", "text": "ok"},
+		{
+			"id": 5, "type": "message", "date": "2019-05-01T10:04:00", "date_unixtime": "1556705040",
+			"from": "Test User", "from_id": "user42", "photo": "photos/photo_1.jpg", "text": ""
+		}
+	]
+}`
+
+func TestImportTelegram(t *testing.T) {
+	opts := testOptions()
+	store := NewMemoryStore()
+	defer store.Close()
+
+	chatID, n, err := ImportTelegram(store, strings.NewReader(telegramHistory), 0, &opts)
+	if err != nil || chatID != -1001234567890 || n != 3 {
+		t.Fatalf("Imported %d messages into %d (%v), want 3 into -1001234567890", n, chatID, err)
+	}
+
+	refs, _ := store.Messages().Get(chatID)
+	want := []MessageRef{
+		{ID: 2, AuthorID: 42, AuthorName: "Test User", Date: 1556704860, Type: messageText, Text: "remember the first meeting"},
+		{ID: 3, AuthorID: 43, AuthorName: "Other", Date: 1556704920, Type: messageText, Text: "it was great indeed", ReplyToID: 2},
+		{ID: 5, AuthorID: 42, AuthorName: "Test User", Date: 1556705040, Type: messagePhoto},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Fatalf("Got messages\n%+v\nwant\n%+v", refs, want)
+	}
+
+	if chatID, _, _ := ImportTelegram(store, strings.NewReader(telegramHistory), -77, &opts); chatID != -77 {
+		t.Fatalf("Imported into %d, want -77", chatID)
+	}
+}
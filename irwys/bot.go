@@ -1,84 +1,69 @@
 package irwys
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
 	"math/rand"
+	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	tgbotapi "github.com/Syfaro/telegram-bot-api"
-	"github.com/smallfish/simpleyaml"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-var (
-	Verbose *log.Logger
-	Info    *log.Logger
-	Warning *log.Logger
-	Error   *log.Logger
-)
-
-var chats = NewSynMap()
-var replies = NewSynMap()
-var lock = sync.RWMutex{}
-
-func Init(
-	verboseHandle io.Writer,
-	infoHandle io.Writer,
-	warningHandle io.Writer,
-	errorHandle io.Writer,
-) {
-	Verbose = log.New(verboseHandle,
-		"VERBOSE: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-
-	Info = log.New(infoHandle,
-		"INFO: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-
-	Warning = log.New(warningHandle,
-		"WARNING: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-
-	Error = log.New(errorHandle,
-		"ERROR: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-}
+// maxRecallAttempts limits how many messages recall tries to forward
+// before giving up on the ones that are gone.
+const maxRecallAttempts = 3
 
 type bot struct {
-	token string
-	opts  *Options
+	token  string
+	config *configBook
+	// tasks tracks goroutines handling updates, which are waited for on shutdown.
+	tasks    *sync.WaitGroup
+	sessions *sessions
+	metrics  *metrics
+	// contact is touched on every update received.
+	contact *contact
 }
 
 func New(
 	token string,
 	opts *Options,
 ) bot {
-	b := bot{token, opts}
+	b := bot{token, newConfigBook(opts), &sync.WaitGroup{}, newSessions(), newMetrics(), &contact{}}
 	return b
 }
 
-func handleRememberErr(err error, update tgbotapi.Update) {
-	if err != nil {
-		Error.Printf("Couldn't remember message\n\tChatId: %d\n\tMessage ID: %d",
-			update.Message.Chat.ID, update.Message.MessageID)
-	}
+// opts returns options the bot currently works with.
+func (b bot) opts() *Options {
+	return b.config.get().opts
+}
+
+// dicts returns reply dictionaries the bot currently works with.
+func (b bot) dicts() *dictionaries {
+	return b.config.get().dicts
 }
 
-func handleRecallErr(err error, update tgbotapi.Update) {
+// spawn runs fn in a goroutine tracked by tasks.
+func (b bot) spawn(fn func()) {
+	b.tasks.Add(1)
+	go func() {
+		defer b.tasks.Done()
+		fn()
+	}()
+}
+
+func handleRememberErr(err error, update tgbotapi.Update) {
 	if err != nil {
-		Error.Printf("Couldn't recall messages\n\tChatId: %d", update.Message.Chat.ID)
+		messageLog(update.Message).Error("Couldn't remember message", "error", err)
 	}
 }
 
-func welcome(update tgbotapi.Update, botAPI *tgbotapi.BotAPI) {
+func welcome(update tgbotapi.Update, botAPI Messenger) {
 	reply := fmt.Sprintf(
 		"*I Remember What You Said bot*\n\n" +
 
@@ -89,7 +74,13 @@ func welcome(update tgbotapi.Update, botAPI *tgbotapi.BotAPI) {
 			"/start - start the bot\n" +
 			"/stop - stop the bot\n" +
 			"/recall - recall random message\n" +
-			"/ru | /en - change the language\n" +
+			"/settings - show or change settings of the chat\n" +
+			"/timezone - show or change time zone of the chat\n" +
+			"/strategy - show or change how messages to recall are picked\n" +
+			"/lang - show or change the language\n" +
+			"/addreply - add a reply phrase of the chat\n" +
+			"/listreplies - list reply phrases of the chat\n" +
+			"/delreply - remove a reply phrase of the chat\n" +
 			"/help - show this message",
 	)
 
@@ -97,272 +88,484 @@ func welcome(update tgbotapi.Update, botAPI *tgbotapi.BotAPI) {
 	msg.ParseMode = "markdown"
 	_, err := botAPI.Send(msg)
 	if err != nil {
-		Error.Printf("Can't send reply to %s\n\tError: %s",
-			update.Message.From.UserName, err)
+		messageLog(update.Message).Error("Can't send reply", "user", update.Message.From.UserName, "error", err)
 	}
 }
 
-func (b bot) remember(dbMessages DB, update tgbotapi.Update) {
+func (b bot) remember(dbMessages MessageStore, settings Settings, update tgbotapi.Update) {
 	if update.Message.Chat.IsChannel() {
-		Warning.Printf("Do not work with channels.")
+		messageLog(update.Message).Warn("Do not work with channels.")
 		return
 	}
 
-	l := len(strings.Split(update.Message.Text, " "))
-	if (l < int(b.opts.minWords) || l > int(b.opts.maxWords)) && update.Message.Photo == nil {
-		return
+	if reply := update.Message.ReplyToMessage; reply != nil {
+		if err := dbMessages.CountReply(update.Message.Chat.ID, reply.MessageID); err != nil {
+			chatLog(update.Message.Chat.ID).Error("Can't count reply", "message_id", reply.MessageID, "error", err)
+		}
 	}
 
-	chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
-	m, err := dbMessages.Get(chatIDStr)
-	handleRecallErr(err, update)
-	if m == nil {
-		m = []int{}
-	}
-	messages := m.([]int)
-	if len(messages) >= int(b.opts.capacity) {
-		messages = messages[len(messages)-int(b.opts.capacity)+1:]
+	ref := newMessageRef(update.Message)
+	if !worthRemembering(settings, ref) {
+		return
 	}
-	err = dbMessages.Put(chatIDStr, append(messages, update.Message.MessageID))
+
+	err := dbMessages.Append(update.Message.Chat.ID, ref, settings.Capacity)
 	handleRememberErr(err, update)
+	if err == nil {
+		b.metrics.remembered.Inc("")
+	}
 }
 
-func (b bot) recall(dbMessages DB, dbChats DB, update tgbotapi.Update, botAPI *tgbotapi.BotAPI) {
-	if update.Message.Chat.IsChannel() {
-		Warning.Printf("Can't send reply to channel %s", update.Message.From.UserName)
-		return
-	}
+// worthRemembering checks if the message fits length limits. Photos are always remembered.
+func worthRemembering(settings Settings, ref MessageRef) bool {
+	l := len(strings.Split(ref.Text, " "))
+	return (l >= settings.MinWords && l <= settings.MaxWords) || ref.Type == messagePhoto
+}
 
-	var lang = "en"
+func (b bot) recall(dbMessages MessageStore, dbChats ChatStore, chatID int64, botAPI Messenger) (ok bool) {
+	var lang string
 
-	rand.Seed(time.Now().UTC().UnixNano())
-	chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
-	rawMessages, err := dbMessages.Get(chatIDStr)
-	handleRecallErr(err, update)
+	b.metrics.attempted.Inc("")
+	evalMessages, err := dbMessages.Get(chatID)
+	if err != nil {
+		Log.Error("Couldn't recall messages", "chat_id", chatID, "error", err)
+		b.metrics.failed.Inc(recallStorageError)
+		return
+	}
 
-	if rawMessages == nil {
+	if len(evalMessages) == 0 {
+		b.metrics.failed.Inc(recallNoMessages)
 		return
 	}
-	evalMessages := rawMessages.([]int)
 
-	rawConf, err := dbChats.Get(strconv.FormatInt(update.Message.Chat.ID, 10))
-	if rawConf != nil {
-		evalConf := rawConf.(map[string]string)
-		lang = evalConf["language"]
+	conf, exist, err := dbChats.Get(chatID)
+	if exist {
+		lang = conf.Language
 	}
 	if err != nil {
-		Error.Printf("Can't get chat reply language\n\tChatId: %d", update.Message.Chat.ID)
+		Log.Error("Can't get chat reply language", "chat_id", chatID, "error", err)
 	}
 
-	fwdMessageID := rand.Intn(len(evalMessages))
-	fwdMsg := tgbotapi.NewForward(update.Message.Chat.ID,
-		update.Message.Chat.ID, evalMessages[fwdMessageID])
-	sent, err := botAPI.Send(fwdMsg)
-	if err != nil {
-		Error.Printf("Can't forward message\n\tChatId: %d\n\t%s", update.Message.Chat.ID, err)
+	// Options and dictionaries are taken together, so a reload can't mix old and new ones.
+	cfg := b.config.get()
+	settings := cfg.opts.settingsOf(conf)
+	sel := selectorOf(settings.Strategy)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	now := time.Now().In(settings.Location)
+	choose := func(candidates []MessageRef) int {
+		return pick(sel, candidates, now, random)
 	}
 
-	possibleReplies := replies.Get(lang).(map[interface{}]interface{})
-	msgType := "text"
+	candidates := withoutRecent(evalMessages, settings.NoRepeat)
+	anniversary := false
+	if n, ok := sel.(narrower); ok {
+		if same := n.narrow(candidates, now); len(same) > 0 {
+			candidates = same
+			anniversary = true
+		}
+	}
+	sent, recalled, ok := recallMessage(dbMessages, chatID, candidates, choose, botAPI)
+	if !ok {
+		Log.Error("Couldn't recall any message", "chat_id", chatID)
+		b.metrics.failed.Inc(recallNotForwarded)
+		return
+	}
+	b.metrics.succeeded.Inc("")
+	if err = dbMessages.MarkRecalled(chatID, recalled.ID, now); err != nil {
+		Log.Error("Can't mark message recalled", "chat_id", chatID, "message_id", recalled.ID, "error", err)
+	}
+
+	dicts := cfg.dicts
+	msgType := textReplies
 	if sent.Photo != nil {
-		msgType = "photo"
+		msgType = photoReplies
+	}
+	var title string
+	if sent.Chat != nil {
+		title = sent.Chat.Title
+	}
+	rc := newReplyContext(recalled, title, now)
+	rc.present = memberPresence(botAPI, chatID, recalled.AuthorID)
+	// Phrases of the chat are mixed with common ones, or replace them along with anniversary ones.
+	own := chatPhrases(chatID, conf, msgType)
+	pool := append(append([]phrase{}, dicts.Pool(lang, msgType)...), own...)
+	if settings.OwnReplies != 0 && len(own) > 0 {
+		pool, anniversary = own, false
+	}
+	var p phrase
+	fits := false
+	if anniversary {
+		p, fits = pickPhrase(dicts.Pool(lang, anniversaryReplies), rc, random)
+	}
+	if !fits {
+		p, fits = pickPhrase(pool, rc, random)
+	}
+	if !fits {
+		Log.Warn("No reply fits the message", "chat_id", chatID, "message_id", recalled.ID)
+		return true
 	}
-	replyID := rand.Intn(len(possibleReplies[msgType].([]interface{})))
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, possibleReplies[msgType].([]interface{})[replyID].(string))
-	_, err = botAPI.Send(msg)
+	reply, err := p.render(rc)
 	if err != nil {
-		Error.Printf("Can't send message\n\tChatId: %d\n\t%s", update.Message.Chat.ID, err)
+		Log.Error("Can't render reply", "chat_id", chatID, "error", err)
+	} else if _, err = botAPI.Send(tgbotapi.NewMessage(chatID, reply)); err != nil {
+		Log.Error("Can't send message", "chat_id", chatID, "error", err)
 	}
 
-	Verbose.Printf("Recalled\n\tChatId: %d\n\tFwdMessageId: %d", update.Message.Chat.ID, evalMessages[fwdMessageID])
+	Log.Debug("Recalled", "chat_id", chatID, "message_id", recalled.ID)
+	return true
 }
 
-func (b bot) language(dbChats DB, update tgbotapi.Update) (err error) {
-	chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
-	lang := update.Message.Text
-	lang = strings.Replace(lang, "/", "", -1)
+// recallMessage forwards one of candidates picked by choose to the chat,
+// trying up to maxRecallAttempts of them.
+// Messages that can't be forwarded anymore are forgotten; if none could be forwarded,
+// content of a forgotten one is posted again instead.
+func recallMessage(
+	dbMessages MessageStore,
+	chatID int64,
+	candidates []MessageRef,
+	choose func(candidates []MessageRef) int,
+	botAPI Messenger,
+) (sent tgbotapi.Message, recalled MessageRef, ok bool) {
+	var dead []MessageRef
+
+	for attempt := 0; attempt < maxRecallAttempts && len(candidates) > 0; attempt++ {
+		i := choose(candidates)
+		ref := candidates[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+
+		sent, err := botAPI.Forward(chatID, chatID, ref.ID)
+		if err == nil {
+			return sent, ref, true
+		}
+		if !isUnforwardable(err) {
+			Log.Error("Can't forward message", "chat_id", chatID, "message_id", ref.ID, "error", err)
+			return sent, ref, false
+		}
 
-	rawConf, err := dbChats.Get(chatIDStr)
-	if err != nil {
-		Error.Printf("Can't get chat information\n\tChatId: %d\n\t%s",
-			update.Message.Chat.ID, err)
-	}
-	if rawConf == nil {
-		rawConf = map[string]string{}
+		Log.Warn("Message can't be forwarded anymore, forgetting it", "chat_id", chatID, "message_id", ref.ID, "error", err)
+		if err = dbMessages.Remove(chatID, ref.ID); err != nil {
+			Log.Error("Can't forget message", "chat_id", chatID, "message_id", ref.ID, "error", err)
+		}
+		dead = append(dead, ref)
 	}
-	evalConf := rawConf.(map[string]string)
 
-	evalConf["language"] = lang
-	err = dbChats.Put(chatIDStr, evalConf)
-	if err != nil {
-		Error.Printf("Can't set language\n\tChatId: %d\n\tLanguage: %s\n\t%s",
-			update.Message.Chat.ID, update.Message.Text, err)
+	for _, ref := range dead {
+		sent, err := repost(botAPI, chatID, ref)
+		if err == nil {
+			return sent, ref, true
+		}
+		Log.Warn("Can't repost message", "chat_id", chatID, "message_id", ref.ID, "error", err)
 	}
 
 	return
 }
 
-func (b bot) watcher(dbMessages DB, dbChats DB, ch chan tgbotapi.Update, botAPI *tgbotapi.BotAPI) {
-	defer close(ch)
+// unforwardableErrors are parts of Telegram errors telling the message itself can't be forwarded.
+var unforwardableErrors = []string{
+	"message to forward not found",
+	"message can't be forwarded",
+	"message has protected content and can't be forwarded",
+	"message_id_invalid",
+}
 
-	var lastUpdateDate time.Time
-	var update tgbotapi.Update
-	var ok = true
-	rand.Seed(time.Now().UTC().UnixNano())
+// isUnforwardable tells if the forwarding error is caused by the message itself
+// (deleted original, restricted forwarding) rather than by the API being unavailable
+// or the bot lacking rights in the chat.
+func isUnforwardable(err error) bool {
+	apiErr, ok := err.(tgbotapi.Error)
+	if !ok || !strings.HasPrefix(apiErr.Message, "Bad Request") {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	for _, part := range unforwardableErrors {
+		if strings.Contains(msg, part) {
+			return true
+		}
+	}
+	return false
+}
 
-	for {
-		select {
-		case update, ok = <-ch:
-			if ok == false {
-				break
-			}
-			b.remember(dbMessages, update)
-			lastUpdateDate = time.Unix(int64(update.Message.Date), 0)
-		default:
-			now := time.Now()
-			if now.Hour() < int(b.opts.timeStart) || now.Hour() >= int(b.opts.timeEnd) ||
-				update.Message == nil {
-				continue
-			}
-			acceptableWindow := now.Add(time.Duration(-b.opts.timeout) * time.Minute)
-			if !lastUpdateDate.After(acceptableWindow) {
-				if rand.Float64() < 0.3 {
-					b.recall(dbMessages, dbChats, update, botAPI)
-				}
-				lastUpdateDate = now
-			}
+// language sets the language of the started chat.
+func (b bot) language(dbChats ChatStore, chatID int64, lang string) error {
+	err := dbChats.Update(chatID, func(conf *ChatConfig) error {
+		conf.Language = lang
+		return nil
+	})
+	if err != nil {
+		Log.Error("Can't set language", "chat_id", chatID, "language", lang, "error", err)
+	}
+	return err
+}
+
+// watcher remembers messages of the chat and schedules a recall for when the chat falls silent.
+func (b bot) watcher(dbMessages MessageStore, dbChats ChatStore, ch <-chan tgbotapi.Update, sched *scheduler) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for update := range ch {
+		settings := b.chatSettings(dbChats, update.Message.Chat.ID)
+		b.remember(dbMessages, settings, update)
+		if !update.Message.Chat.IsChannel() {
+			policy := newRecallPolicy(settings, random)
+			sched.Schedule(update.Message.Chat.ID, policy.afterMessage(update.Message.Time()))
 		}
-		time.Sleep(time.Duration(1) * time.Millisecond)
 	}
 }
 
-func (b bot) start(dbChats DB, update tgbotapi.Update) {
-	chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
+// due is called by the scheduler once the chat has been silent for the timeout.
+// The recall policy decides if it's time to recall and when the chat is due again,
+// unless a new message arrives first.
+func (b bot) due(dbMessages MessageStore, dbChats ChatStore, sched *scheduler, chatID int64, botAPI Messenger) {
+	if !b.sessions.Exist(chatID) {
+		return
+	}
+
+	conf, _, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat settings", "chat_id", chatID, "error", err)
+	}
+	settings := b.opts().settingsOf(conf)
+	policy := newRecallPolicy(settings, rand.New(rand.NewSource(time.Now().UnixNano())))
+
+	now := time.Now()
+	recall, next := policy.decide(now, conf.Recalls)
+	if recall && b.recall(dbMessages, dbChats, chatID, botAPI) {
+		err = dbChats.Update(chatID, func(conf *ChatConfig) error {
+			conf.Recalls = conf.Recalls.add(now, settings.Location)
+			return nil
+		})
+		if err != nil {
+			Log.Error("Can't save recall stats", "chat_id", chatID, "error", err)
+		}
+	}
+	sched.Schedule(chatID, next)
+}
+
+// chatSettings returns effective settings of the chat.
+func (b bot) chatSettings(dbChats ChatStore, chatID int64) Settings {
+	conf, _, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat settings", "chat_id", chatID, "error", err)
+	}
+	return b.opts().settingsOf(conf)
+}
 
-	if exist, _ := dbChats.Exist(chatIDStr); exist {
+func (b bot) start(dbChats ChatStore, update tgbotapi.Update) {
+	if exist, _ := dbChats.Exist(update.Message.Chat.ID); exist {
 		return
 	}
 
-	update.Message.Text = "en"
-	if err := b.language(dbChats, update); err != nil {
-		Error.Printf("Failed to start\n\tChatId: %d\n\tError: %s",
-			update.Message.Chat.ID, err)
+	if err := dbChats.Put(update.Message.Chat.ID, ChatConfig{Language: b.opts().Language}); err != nil {
+		Log.Error("Failed to start", "chat_id", update.Message.Chat.ID, "error", err)
 	} else {
-		Info.Printf("Bot successfully started\n\tChatId: %d", update.Message.Chat.ID)
+		Log.Info("Bot successfully started", "chat_id", update.Message.Chat.ID)
 	}
 }
 
-func (b bot) stop(dbChats DB, update tgbotapi.Update) {
-	chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
-
-	if exist, _ := dbChats.Exist(chatIDStr); !exist {
+func (b bot) stop(dbChats ChatStore, sched *scheduler, update tgbotapi.Update) {
+	if exist, _ := dbChats.Exist(update.Message.Chat.ID); !exist {
 		return
 	}
 
-	err := dbChats.Delete(chatIDStr)
+	err := dbChats.Delete(update.Message.Chat.ID)
 	if err != nil {
-		Error.Printf("Can't remove chat\n\tChatId: %d\n\tError: %s",
-			update.Message.Chat.ID, err)
+		Log.Error("Can't remove chat", "chat_id", update.Message.Chat.ID, "error", err)
 	}
 
-	if chats.Exist(chatIDStr) {
-		c := chats.Get(chatIDStr).(chan tgbotapi.Update)
-		close(c)
-		chats.Delete(chatIDStr)
-	}
+	// Messages the session is left with may schedule the chat, so it's removed after.
+	b.sessions.Stop(update.Message.Chat.ID)
+	sched.Remove(update.Message.Chat.ID)
 
 	if err != nil {
-		Error.Printf("Failed to stop\n\tChatId: %d\n\tError: %s",
-			update.Message.Chat.ID, err)
+		Log.Error("Failed to stop", "chat_id", update.Message.Chat.ID, "error", err)
 	} else {
-		Info.Printf("Bot successfully stopped\n\tChatId: %d", update.Message.Chat.ID)
+		Log.Info("Bot successfully stopped", "chat_id", update.Message.Chat.ID)
 	}
 }
 
-func (b bot) initBot(dbMessages DB, dbChats DB, botAPI *tgbotapi.BotAPI) {
-	for _, lang := range []string{"en", "ru"} {
-		rawData, err := ioutil.ReadFile(filepath.Join(b.opts.replyPath, fmt.Sprintf("%s.yml", lang)))
-		if err != nil {
-			Error.Printf("Can't open file with replies\n\tPath: %s\n\tError: %s", b.opts.replyPath, err)
-		}
-
-		ymlData, err := simpleyaml.NewYaml(rawData)
-		if err != nil {
-			Error.Printf("Can't convert replies to YAML\n\tPath: %s\n\tError: %s", b.opts.replyPath, err)
-		}
-
-		m, _ := ymlData.Map()
-		replies.Put(lang, m)
+func (b bot) initBot(dbMessages MessageStore, dbChats ChatStore, sched *scheduler) error {
+	opts := b.opts()
+	dicts, err := loadDictionaries(opts.ReplyPath, opts.Language)
+	if err != nil {
+		return err
 	}
+	b.config.set(config{opts, dicts})
+	Log.Info("Loaded replies", "path", opts.ReplyPath, "languages", strings.Join(dicts.Languages(), ","))
 
-	for it := dbChats.Iterate(nil); it.Next(); {
-		k, _ := it.Key(), it.Value()
-		ch := make(chan tgbotapi.Update, 1)
-		chats.Put(string(k), ch)
-		go b.watcher(dbMessages, dbChats, ch, botAPI)
+	ids, err := dbChats.IDs()
+	if err != nil {
+		Log.Error("Can't list chats", "error", err)
+	}
+	for _, id := range ids {
+		b.startSession(dbMessages, dbChats, sched, id)
 	}
+	return nil
+}
+
+// startSession starts watching the chat, unless it's watched already.
+func (b bot) startSession(dbMessages MessageStore, dbChats ChatStore, sched *scheduler, chatID int64) {
+	b.sessions.Start(chatID, func(updates <-chan tgbotapi.Update) {
+		b.watcher(dbMessages, dbChats, updates, sched)
+	})
 }
 
 func (b bot) Start() {
-	if b.opts.verbose {
-		Init(os.Stdout, os.Stdout, os.Stdout, os.Stderr)
+	store, err := b.opts().Open()
+	if err != nil {
+		Log.Error("Can't open storage", "error", err)
+		panic(err)
+	}
+	defer store.Close()
+	dbMessages := store.Messages()
+	dbChats := store.Chats()
+
+	var botAPI Messenger
+	if b.opts().Webhook != "" {
+		botAPI, err = NewWebhookMessenger(
+			b.token, b.opts().Webhook, b.opts().Listen, b.opts().Secret, b.opts().TLSCert, b.opts().TLSKey,
+		)
 	} else {
-		Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+		botAPI, err = NewTelegramMessenger(b.token)
 	}
+	if err != nil {
+		Log.Error("Can't authenticate with given token", "error", err)
+		panic(err)
+	}
+
+	Log.Info("Authorized", "account", botAPI.Self().UserName)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go b.reloadOn(ctx, syscall.SIGHUP)
 
-	o := &opt.Options{
-		BlockCacheCapacity: 128 * opt.MiB,
-		WriteBuffer:        16 * opt.MiB,
+	if b.opts().AdminListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", b.metrics.handler(store))
+		if b.opts().Health {
+			h := b.health(store, botAPI)
+			mux.HandleFunc("/healthz", h.healthz)
+			mux.HandleFunc("/readyz", h.readyz)
+		}
+		if err = serveAdmin(ctx, b.opts().AdminListen, mux); err != nil {
+			Log.Error("Can't start admin server", "error", err)
+			panic(err)
+		}
+		Log.Info("Serving admin HTTP server", "address", b.opts().AdminListen, "health", b.opts().Health)
 	}
-	dbMessages := NewDB(b.opts.dbPath, "messages", o)
-	defer dbMessages.Close()
-	dbChats := NewDB(b.opts.dbPath, "chats", o)
-	defer dbChats.Close()
 
-	botAPI, err := tgbotapi.NewBotAPI(b.token)
-	if err != nil {
-		Error.Println("Can't authenticate with given token")
+	if err = b.serve(ctx, dbMessages, dbChats, botAPI); err != nil {
+		Log.Error("Bot failed", "error", err)
 		panic(err)
 	}
+	Log.Info("Bot stopped")
+}
 
-	Info.Printf("Authorized on account %s", botAPI.Self.UserName)
+// health reports the state of the bot, which reaches Telegram through botAPI.
+func (b bot) health(store Store, botAPI Messenger) *health {
+	contacts := []func() time.Time{b.contact.time}
+	if c, ok := botAPI.(contacter); ok {
+		contacts = append(contacts, c.LastContact)
+	}
+	return newHealth(store, b.sessions, staleContact, contacts...)
+}
 
-	b.initBot(dbMessages, dbChats, botAPI)
+// serve dispatches updates received from the messenger until ctx is done or its update channel is closed.
+// Before returning it stops receiving updates, lets watchers remember messages left in chat channels
+// and waits for all handlers, so the storage may be closed right after.
+func (b bot) serve(ctx context.Context, dbMessages MessageStore, dbChats ChatStore, botAPI Messenger) error {
+	botAPI = countingMessenger{botAPI, b.metrics.apiErrors}
+
+	var sched *scheduler
+	sched = newScheduler(func(chatID int64) {
+		b.due(dbMessages, dbChats, sched, chatID, botAPI)
+	})
+	stopScheduler := make(chan struct{})
+	schedulerStopped := make(chan struct{})
+	go func() {
+		sched.Run(stopScheduler)
+		close(schedulerStopped)
+	}()
+	defer func() {
+		close(stopScheduler)
+		<-schedulerStopped
+		b.sessions.StopAll()
+		b.tasks.Wait()
+	}()
+
+	if err := b.initBot(dbMessages, dbChats, sched); err != nil {
+		return fmt.Errorf("can't load replies: %s", err)
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	updates, err := botAPI.Updates(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get updates: %s", err)
+	}
 
-	updates, err := botAPI.GetUpdatesChan(u)
+	for {
+		var update tgbotapi.Update
+		var ok bool
+		select {
+		case <-ctx.Done():
+			Log.Info("Shutting down")
+			return nil
+		case update, ok = <-updates:
+		}
+		if !ok {
+			return nil
+		}
+		b.contact.touch()
+		b.metrics.updates.Inc(updateType(update))
 
-	for update := range updates {
+		if update.CallbackQuery != nil &&
+			strings.HasPrefix(update.CallbackQuery.Data, settingsCallback+" ") {
+			query := update.CallbackQuery
+			b.spawn(func() { b.settingsButton(dbChats, query, botAPI) })
+			continue
+		}
 		if update.Message == nil {
 			continue
 		}
 
-		chatIDStr := strconv.FormatInt(update.Message.Chat.ID, 10)
-
-		Info.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
-		Verbose.Printf("ChatId: %d", update.Message.Chat.ID)
+		messageLog(update.Message).Debug("Received message",
+			"user", update.Message.From.UserName, textKey, update.Message.Text)
 
 		switch update.Message.Command() {
 		case "start":
-			go welcome(update, botAPI)
+			b.spawn(func() { welcome(update, botAPI) })
 			b.start(dbChats, update)
-			ch := make(chan tgbotapi.Update, 1)
-			chats.Put(chatIDStr, ch)
-			go b.watcher(dbMessages, dbChats, ch, botAPI)
+			b.startSession(dbMessages, dbChats, sched, update.Message.Chat.ID)
 		case "stop":
-			b.stop(dbChats, update)
+			b.stop(dbChats, sched, update)
 		case "help":
-			go welcome(update, botAPI)
+			b.spawn(func() { welcome(update, botAPI) })
 		case "recall":
-			go b.recall(dbMessages, dbChats, update, botAPI)
-		case "ru", "en":
-			go b.language(dbChats, update)
+			if update.Message.Chat.IsChannel() {
+				messageLog(update.Message).Warn("Can't send reply to channel", "title", update.Message.Chat.Title)
+				break
+			}
+			chatID := update.Message.Chat.ID
+			b.spawn(func() { b.recall(dbMessages, dbChats, chatID, botAPI) })
+		case "settings":
+			b.spawn(func() { b.settings(dbChats, update, botAPI) })
+		case "timezone":
+			b.spawn(func() { b.timezone(dbChats, update, botAPI) })
+		case "strategy":
+			b.spawn(func() { b.strategy(dbChats, update, botAPI) })
+		case "lang":
+			b.spawn(func() { b.lang(dbChats, update, botAPI, update.Message.CommandArguments()) })
+		case "addreply":
+			b.spawn(func() { b.addReply(dbChats, update, botAPI) })
+		case "listreplies":
+			b.spawn(func() { b.listReplies(dbChats, update, botAPI) })
+		case "delreply":
+			b.spawn(func() { b.delReply(dbChats, update, botAPI) })
+		default:
+			// Language codes are commands too, e.g. /ru is /lang ru.
+			if cmd := update.Message.Command(); cmd != "" && b.dicts().Has(cmd) {
+				b.spawn(func() { b.lang(dbChats, update, botAPI, cmd) })
+			}
 		}
 
-		if chats.Exist(chatIDStr) {
-			chats.Get(chatIDStr).(chan tgbotapi.Update) <- update
-		}
+		b.sessions.Deliver(update.Message.Chat.ID, update)
 	}
 }
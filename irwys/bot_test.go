@@ -0,0 +1,577 @@
+package irwys
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+	"text/template/parse"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+var testUser = &tgbotapi.User{ID: 42, FirstName: "Test", UserName: "tester"}
+
+type testEnv struct {
+	b          bot
+	store      Store
+	dbMessages MessageStore
+	dbChats    ChatStore
+	fake       *FakeMessenger
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	fake := NewFakeMessenger(tgbotapi.User{ID: 1, UserName: "irwys_bot", IsBot: true})
+	return startTestEnv(t, fake, fake)
+}
+
+// startTestEnv serves updates received by botAPI, which sends through fake, until the test ends.
+func startTestEnv(t *testing.T, fake *FakeMessenger, botAPI Messenger) *testEnv {
+
+	dir := t.TempDir()
+	// Recalls triggered by silence are disabled by an empty active window,
+	// so only explicit /recall commands produce forwards.
+	opts := Options{
+		MinWords: 2, MaxWords: 100, Timeout: 600, Capacity: 16, Probability: 30,
+		Strategy: "uniform", Storage: MemoryStorage, DBPath: dir, ReplyPath: "../replies", Language: "en",
+	}
+	store := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	env := &testEnv{
+		b:          New("", &opts),
+		store:      store,
+		dbMessages: store.Messages(),
+		dbChats:    store.Chats(),
+		fake:       fake,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		env.b.serve(ctx, env.dbMessages, env.dbChats, botAPI)
+		close(env.done)
+	}()
+
+	t.Cleanup(func() {
+		env.cancel()
+		<-env.done
+		env.store.Close()
+	})
+
+	return env
+}
+
+func (env *testEnv) expectSent(t *testing.T) tgbotapi.Message {
+	t.Helper()
+	select {
+	case msg := <-env.fake.Sent():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the bot to send a message")
+	}
+	return tgbotapi.Message{}
+}
+
+func (env *testEnv) waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (env *testEnv) remembered(chat *tgbotapi.Chat) []int {
+	refs, _ := env.dbMessages.Get(chat.ID)
+	ids := []int{}
+	for _, ref := range refs {
+		ids = append(ids, ref.ID)
+	}
+	return ids
+}
+
+func (env *testEnv) language(chat *tgbotapi.Chat) string {
+	conf, _, _ := env.dbChats.Get(chat.ID)
+	return conf.Language
+}
+
+func (env *testEnv) replyPool(lang string, msgType string) []phrase {
+	return env.b.dicts().Pool(lang, msgType)
+}
+
+// contains checks if s could be rendered from one of phrases of the pool,
+// matching template actions to anything.
+func contains(pool []phrase, s string) bool {
+	for _, p := range pool {
+		pattern := "^"
+		for _, node := range p.tmpl.Tree.Root.Nodes {
+			if text, ok := node.(*parse.TextNode); ok {
+				pattern += regexp.QuoteMeta(string(text.Text))
+			} else {
+				pattern += "(?s:.*)"
+			}
+		}
+		if regexp.MustCompile(pattern + "$").MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStartSendsWelcome(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1001, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+
+	msg := env.expectSent(t)
+	if msg.Chat.ID != chat.ID || !strings.Contains(msg.Text, "I Remember What You Said bot") {
+		t.Fatalf("Unexpected welcome message: %+v", msg)
+	}
+	env.waitFor(t, "default language", func() bool { return env.language(chat) == "en" })
+}
+
+func TestRecallForwardsRememberedMessage(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1002, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	first := env.fake.Post(chat, testUser, "first message worth remembering")
+	second := env.fake.Post(chat, testUser, "second message worth remembering")
+	env.waitFor(t, "messages to be remembered", func() bool { return len(env.remembered(chat)) == 2 })
+
+	env.fake.Post(chat, testUser, "/recall")
+
+	fwd := env.expectSent(t)
+	if fwd.ForwardFromMessageID != first.MessageID && fwd.ForwardFromMessageID != second.MessageID {
+		t.Fatalf("Forwarded unexpected message %d", fwd.ForwardFromMessageID)
+	}
+	reply := env.expectSent(t)
+	if !contains(env.replyPool("en", "text"), reply.Text) {
+		t.Fatalf("Reply %q is not an english text reply", reply.Text)
+	}
+}
+
+func TestLanguageCommand(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1003, Type: "group"}
+
+	// Language codes of a chat that isn't started don't create its record.
+	env.fake.Post(chat, testUser, "/ru")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "/start") {
+		t.Fatalf("Reply %q doesn't ask to start the bot", msg.Text)
+	}
+	if exist, _ := env.dbChats.Exist(chat.ID); exist {
+		t.Fatal("Language code created a record of the chat")
+	}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	env.fake.Post(chat, testUser, "/ru")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Only chat administrators") {
+		t.Fatalf("Reply %q doesn't reject a non-admin", msg.Text)
+	}
+	env.fake.SetAdmin(chat.ID, testUser.ID)
+	env.fake.Post(chat, testUser, "/ru")
+	if msg := env.expectSent(t); msg.Text != "Language of the chat is set to ru." {
+		t.Fatalf("Unexpected reply %q", msg.Text)
+	}
+	if env.language(chat) != "ru" {
+		t.Fatalf("Language is %q, want ru", env.language(chat))
+	}
+
+	msg := env.fake.Post(chat, testUser, "something to remember later")
+	env.waitFor(t, "message to be remembered", func() bool { return len(env.remembered(chat)) == 1 })
+
+	env.fake.Post(chat, testUser, "/recall")
+
+	if fwd := env.expectSent(t); fwd.ForwardFromMessageID != msg.MessageID {
+		t.Fatalf("Forwarded %d, want %d", fwd.ForwardFromMessageID, msg.MessageID)
+	}
+	if reply := env.expectSent(t); !contains(env.replyPool("ru", "text"), reply.Text) {
+		t.Fatalf("Reply %q is not a russian text reply", reply.Text)
+	}
+}
+
+func TestStopForgetsChat(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1004, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	before := env.fake.Post(chat, testUser, "said before the bot was stopped")
+
+	env.fake.Post(chat, testUser, "/stop")
+	env.waitFor(t, "chat to be removed", func() bool { return env.language(chat) == "" })
+	env.fake.Post(chat, testUser, "said while the bot was stopped")
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	after := env.fake.Post(chat, testUser, "said after the bot was restarted")
+
+	env.waitFor(t, "messages to be remembered", func() bool { return len(env.remembered(chat)) == 2 })
+	if got := env.remembered(chat); got[0] != before.MessageID || got[1] != after.MessageID {
+		t.Fatalf("Remembered %v, want [%d %d]", got, before.MessageID, after.MessageID)
+	}
+}
+
+func TestRecallRepostsDeletedMessage(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1005, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	msg := env.fake.Post(chat, testUser, "this will be deleted soon")
+	env.waitFor(t, "message to be remembered", func() bool { return len(env.remembered(chat)) == 1 })
+
+	refs, _ := env.dbMessages.Get(chat.ID)
+	if ref := refs[0]; ref.AuthorID != testUser.ID || ref.Author != testUser.UserName ||
+		ref.Type != "text" || ref.Text != msg.Text || ref.Date != int64(msg.Date) {
+		t.Fatalf("Remembered %+v, want content of %+v", ref, msg)
+	}
+
+	env.fake.Delete(chat.ID, msg.MessageID)
+	env.fake.Post(chat, testUser, "/recall")
+
+	repost := env.expectSent(t)
+	if repost.ForwardFromMessageID != 0 || !strings.HasPrefix(repost.Text, msg.Text) ||
+		!strings.HasSuffix(repost.Text, "@"+testUser.UserName) {
+		t.Fatalf("Unexpected repost: %+v", repost)
+	}
+	if reply := env.expectSent(t); !contains(env.replyPool("en", "text"), reply.Text) {
+		t.Fatalf("Reply %q is not an english text reply", reply.Text)
+	}
+}
+
+func (env *testEnv) expectNothingSent(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-env.fake.Sent():
+		t.Fatalf("Unexpected message sent: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRecallForgetsUnforwardableMessages(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1006, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	// Messages migrated from the legacy format have no content to repost.
+	gone := []MessageRef{{ID: 9001}, {ID: 9002}, {ID: 9003}, {ID: 9004}}
+	if err := env.dbMessages.Put(chat.ID, gone); err != nil {
+		t.Fatal(err)
+	}
+
+	env.fake.Post(chat, testUser, "/recall")
+
+	env.waitFor(t, "dead messages to be forgotten", func() bool {
+		return len(env.remembered(chat)) == len(gone)-maxRecallAttempts
+	})
+	env.expectNothingSent(t)
+}
+
+// mutedMessenger fails forwards the way Telegram does when the bot can't post to the chat.
+type mutedMessenger struct {
+	*FakeMessenger
+}
+
+func (m mutedMessenger) Forward(chatID int64, fromChatID int64, messageID int) (tgbotapi.Message, error) {
+	return tgbotapi.Message{}, tgbotapi.Error{Message: "Bad Request: not enough rights to send text messages to the chat"}
+}
+
+func TestRecallKeepsMessagesOfMutedBot(t *testing.T) {
+	fake := NewFakeMessenger(tgbotapi.User{ID: 1, UserName: "irwys_bot", IsBot: true})
+	env := startTestEnv(t, fake, mutedMessenger{fake})
+	chat := &tgbotapi.Chat{ID: 1007, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	kept := []MessageRef{{ID: 9001}, {ID: 9002}, {ID: 9003}, {ID: 9004}}
+	if err := env.dbMessages.Put(chat.ID, kept); err != nil {
+		t.Fatal(err)
+	}
+
+	env.fake.Post(chat, testUser, "/recall")
+	env.waitFor(t, "recall to fail", func() bool {
+		return env.b.metrics.failed.Get(recallNotForwarded) == 1
+	})
+	if got := env.remembered(chat); len(got) != len(kept) {
+		t.Fatalf("Remembered %v, want all of %d messages kept", got, len(kept))
+	}
+}
+
+func TestSettingsRestrictedToAdmins(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1007, Type: "group"}
+	admin := &tgbotapi.User{ID: 43, FirstName: "Admin", UserName: "admin"}
+	env.fake.SetAdmin(chat.ID, admin.ID)
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	env.fake.Post(chat, testUser, "/settings minWords 1")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Only chat administrators") {
+		t.Fatalf("Non-admin change wasn't rejected: %q", msg.Text)
+	}
+
+	env.fake.Post(chat, admin, "/settings minWords 1")
+	settings := env.expectSent(t)
+	if !strings.Contains(settings.Text, "Minimal message length (in words): `1`") {
+		t.Fatalf("Settings don't show the override: %q", settings.Text)
+	}
+	conf, _, _ := env.dbChats.Get(chat.ID)
+	if conf.Language != "en" || conf.Settings["minWords"] != 1 {
+		t.Fatalf("Unexpected chat config %+v", conf)
+	}
+
+	env.fake.Press(settings, testUser, "settings timeEnd dec")
+	if answer := <-env.fake.Answers(); !strings.Contains(answer.Text, "Only chat administrators") {
+		t.Fatalf("Non-admin press wasn't rejected: %q", answer.Text)
+	}
+	env.fake.Press(settings, admin, "settings timeEnd inc")
+	<-env.fake.Answers()
+	if edited := env.expectSent(t); edited.MessageID != settings.MessageID ||
+		!strings.Contains(edited.Text, "Hour to stop recalling: `1`") {
+		t.Fatalf("Settings message wasn't updated: %+v", edited)
+	}
+	env.fake.Press(settings, admin, "settings minWords reset")
+	<-env.fake.Answers()
+	env.expectSent(t)
+
+	conf, _, _ = env.dbChats.Get(chat.ID)
+	if len(conf.Settings) != 1 || conf.Settings["timeEnd"] != 1 {
+		t.Fatalf("Unexpected chat settings %v", conf.Settings)
+	}
+}
+
+func TestSettingsApplyPerChat(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1008, Type: "private"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	env.fake.Post(chat, testUser, "/settings minWords 1")
+	env.expectSent(t)
+
+	msg := env.fake.Post(chat, testUser, "short")
+	env.waitFor(t, "short message to be remembered", func() bool {
+		ids := env.remembered(chat)
+		return len(ids) > 0 && ids[len(ids)-1] == msg.MessageID
+	})
+}
+
+func TestTimezoneCommand(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1009, Type: "private"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	env.fake.Post(chat, testUser, "/timezone Mars/Olympus_Mons")
+	if msg := env.expectSent(t); !strings.HasPrefix(msg.Text, "Unknown time zone") {
+		t.Fatalf("Unknown time zone wasn't rejected: %q", msg.Text)
+	}
+
+	env.fake.Post(chat, testUser, "/timezone Asia/Tokyo")
+	env.expectSent(t)
+	if conf, _, _ := env.dbChats.Get(chat.ID); conf.Timezone != "Asia/Tokyo" {
+		t.Fatalf("Time zone is %q, want Asia/Tokyo", conf.Timezone)
+	}
+	if s := env.b.chatSettings(env.dbChats, chat.ID); s.Location.String() != "Asia/Tokyo" {
+		t.Fatalf("Settings location is %s, want Asia/Tokyo", s.Location)
+	}
+}
+
+func TestRepliesAndRecallsAreCounted(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1010, Type: "group"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	msg := env.fake.Post(chat, testUser, "a message people reply to")
+	env.fake.Deliver(tgbotapi.Message{Chat: chat, From: testUser, Text: "+1", ReplyToMessage: &msg})
+	env.waitFor(t, "reply to be counted", func() bool {
+		refs, _ := env.dbMessages.Get(chat.ID)
+		return len(refs) == 1 && refs[0].Replies == 1
+	})
+
+	env.fake.Post(chat, testUser, "/recall")
+	env.expectSent(t)
+	env.expectSent(t)
+	env.waitFor(t, "recall to be counted", func() bool {
+		refs, _ := env.dbMessages.Get(chat.ID)
+		return refs[0].Recalled == 1 && refs[0].RecalledAt > 0
+	})
+}
+
+func TestAnniversaryRecall(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1011, Type: "private"}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	env.fake.Post(chat, testUser, "/strategy anniversary")
+	env.expectSent(t)
+
+	now := time.Now().In(time.Local)
+	old := env.fake.Deliver(tgbotapi.Message{
+		Chat: chat, From: testUser, Text: "said three years ago",
+		Date: int(now.AddDate(-3, 0, 0).Unix()),
+	})
+	var last tgbotapi.Message
+	for i := 1; i <= 5; i++ {
+		last = env.fake.Deliver(tgbotapi.Message{
+			Chat: chat, From: testUser, Text: "said some other day",
+			Date: int(now.AddDate(0, 0, -i*7).Unix()),
+		})
+	}
+	env.waitFor(t, "messages to be remembered", func() bool {
+		ids := env.remembered(chat)
+		return len(ids) > 0 && ids[len(ids)-1] == last.MessageID
+	})
+
+	env.fake.Post(chat, testUser, "/recall")
+
+	if fwd := env.expectSent(t); fwd.ForwardFromMessageID != old.MessageID {
+		t.Fatalf("Forwarded %d, want anniversary message %d", fwd.ForwardFromMessageID, old.MessageID)
+	}
+	if reply := env.expectSent(t); !strings.Contains(reply.Text, "3 year(s)") {
+		t.Fatalf("Reply %q doesn't mention years", reply.Text)
+	}
+}
+
+func TestShutdownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	env := newTestEnv(t)
+	chats := []*tgbotapi.Chat{{ID: 1013, Type: "group"}, {ID: 1014, Type: "group"}}
+	for _, chat := range chats {
+		env.fake.Post(chat, testUser, "/start")
+		env.expectSent(t)
+		env.fake.Post(chat, testUser, "something worth remembering")
+		env.fake.Post(chat, testUser, "/recall")
+	}
+	last := env.fake.Post(chats[0], testUser, "said right before shutdown")
+	env.waitFor(t, "updates to be received", func() bool { return len(env.fake.updates) == 0 })
+
+	env.cancel()
+	select {
+	case <-env.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the bot to stop")
+	}
+
+	// Messages received before shutdown are remembered before serve returns.
+	if ids := env.remembered(chats[0]); len(ids) == 0 || ids[len(ids)-1] != last.MessageID {
+		t.Fatalf("Remembered %v, want the last message %d", ids, last.MessageID)
+	}
+	env.store.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+			t.Fatalf("%d goroutines are running after shutdown, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConcurrentStartStop(t *testing.T) {
+	env := newTestEnv(t)
+	chats := []*tgbotapi.Chat{{ID: 1015, Type: "group"}, {ID: 1016, Type: "group"}}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				chat := chats[(i+j)%len(chats)]
+				switch j % 3 {
+				case 0:
+					env.fake.Post(chat, testUser, "/start")
+				case 1:
+					env.fake.Post(chat, testUser, "/stop")
+				default:
+					env.fake.Post(chat, testUser, "said while starting and stopping")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, chat := range chats {
+		env.fake.Post(chat, testUser, "/start")
+	}
+	last := env.fake.Post(chats[0], testUser, "said once started for good")
+	env.waitFor(t, "message to be remembered", func() bool {
+		ids := env.remembered(chats[0])
+		return len(ids) > 0 && ids[len(ids)-1] == last.MessageID
+	})
+	if n := env.b.sessions.Len(); n != len(chats) {
+		t.Fatalf("Got %d sessions, want %d", n, len(chats))
+	}
+
+	env.fake.Post(chats[1], testUser, "/stop")
+	env.waitFor(t, "chat to be stopped", func() bool { return !env.b.sessions.Exist(chats[1].ID) })
+}
+
+func TestLangCommand(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1021, Type: "private"}
+
+	env.fake.Post(chat, testUser, "/lang")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "/start") {
+		t.Fatalf("Reply %q doesn't ask to start the bot", msg.Text)
+	}
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	env.fake.Post(chat, testUser, "/lang")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "is en") || !strings.Contains(msg.Text, "en, ru") {
+		t.Fatalf("Reply %q doesn't list languages", msg.Text)
+	}
+
+	env.fake.Post(chat, testUser, "/lang xx")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Unknown language xx") {
+		t.Fatalf("Reply %q doesn't reject unknown language", msg.Text)
+	}
+	env.fake.Post(chat, testUser, "/lang ru")
+	if msg := env.expectSent(t); msg.Text != "Language of the chat is set to ru." {
+		t.Fatalf("Unexpected reply %q", msg.Text)
+	}
+	if env.language(chat) != "ru" {
+		t.Fatalf("Language is %q, want ru", env.language(chat))
+	}
+
+	// A language without replies, e.g. one whose file was removed, falls back to the default.
+	env.dbChats.Update(chat.ID, func(conf *ChatConfig) error { conf.Language = "xx"; return nil })
+	msg := env.fake.Post(chat, testUser, "something to remember later")
+	env.waitFor(t, "message to be remembered", func() bool {
+		ids := env.remembered(chat)
+		return len(ids) > 0 && ids[len(ids)-1] == msg.MessageID
+	})
+	env.fake.Post(chat, testUser, "/recall")
+	env.expectSent(t)
+	if reply := env.expectSent(t); !contains(env.replyPool("en", textReplies), reply.Text) {
+		t.Fatalf("Reply %q is not an english text reply", reply.Text)
+	}
+}
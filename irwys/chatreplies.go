@@ -0,0 +1,259 @@
+package irwys
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// Limits of reply phrases of a chat.
+const (
+	maxChatReplies     = 50
+	maxChatReplyLength = 512
+)
+
+// chatReplyKeys lists kinds of recalled messages chats can have phrases for.
+var chatReplyKeys = []string{textReplies, photoReplies}
+
+// chatPhrases returns phrases of the chat kept under the key.
+// Phrases that don't parse anymore are skipped.
+func chatPhrases(chatID int64, conf ChatConfig, key string) []phrase {
+	var pool []phrase
+	for i, text := range conf.Replies[key] {
+		p, err := newChatPhrase(text)
+		if err != nil {
+			Log.Warn("Skipping invalid reply of the chat", "chat_id", chatID, "key", key, "index", i+1, "error", err)
+			continue
+		}
+		pool = append(pool, p)
+	}
+	return pool
+}
+
+// newChatPhrase creates a phrase of a chat. As anyone may add them in private chats,
+// their templates are limited to text, fields of the reply context and if/else on them,
+// so that rendering them takes no longer than reading them.
+func newChatPhrase(text string) (phrase, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return phrase{}, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return phrase{}, fmt.Errorf("define and block aren't allowed in chat replies")
+	}
+	if err = restricted(tmpl.Tree.Root); err != nil {
+		return phrase{}, err
+	}
+	return newPhrase(text)
+}
+
+// restricted checks the template node has nothing but text, fields and if/else on fields.
+func restricted(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := restricted(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parse.TextNode:
+		return nil
+	case *parse.ActionNode:
+		return plainField(n.Pipe)
+	case *parse.IfNode:
+		if err := plainField(n.Pipe); err != nil {
+			return err
+		}
+		if err := restricted(n.List); err != nil {
+			return err
+		}
+		return restricted(n.ElseList)
+	}
+	return fmt.Errorf("only fields and if/else are allowed in chat replies, not %s", node)
+}
+
+// plainField checks the pipeline is a single field of the reply context, like .Author.
+func plainField(pipe *parse.PipeNode) error {
+	if len(pipe.Decl) == 0 && len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) == 1 {
+		if field, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode); ok && len(field.Ident) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("only fields like {{.Author}} are allowed in chat replies, not %s", pipe)
+}
+
+// withChatReplies returns phrases of the chat with the ones under the key replaced,
+// leaving the phrases conf refers to as they are.
+func withChatReplies(conf ChatConfig, key string, pool []string) map[string][]string {
+	replies := map[string][]string{}
+	for k, v := range conf.Replies {
+		replies[k] = v
+	}
+	if len(pool) == 0 {
+		delete(replies, key)
+	} else {
+		replies[key] = pool
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	return replies
+}
+
+// chatRepliesAdmin gets the chat for a command managing its phrases,
+// checking the chat is started and the sender is its administrator.
+func chatRepliesAdmin(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) (ChatConfig, bool) {
+	chatID := update.Message.Chat.ID
+
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat information", "chat_id", chatID, "error", err)
+		return conf, false
+	}
+	if !ok {
+		say(botAPI, chatID, "Start the bot with /start first.")
+		return conf, false
+	}
+	if !isAdmin(botAPI, update.Message.Chat, update.Message.From.ID) {
+		say(botAPI, chatID, "Only chat administrators can manage replies.")
+		return conf, false
+	}
+	return conf, true
+}
+
+// replyKey parses the kind of recalled messages a phrase is for.
+func replyKey(arg string) (string, bool) {
+	key := strings.ToLower(arg)
+	return key, containsString(chatReplyKeys, key)
+}
+
+// addReply adds a phrase of the chat, given `<text|photo> <phrase>` arguments.
+func (b bot) addReply(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+	if _, ok := chatRepliesAdmin(dbChats, update, botAPI); !ok {
+		return
+	}
+
+	args := strings.TrimSpace(update.Message.CommandArguments())
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		say(botAPI, chatID, fmt.Sprintf(
+			"Usage: /addreply <%s> <phrase>\nPhrases may refer to the recalled message, "+
+				"e.g. /addreply text {{.Author}} said this {{.Days}} days ago", strings.Join(chatReplyKeys, "|")))
+		return
+	}
+	key, ok := replyKey(fields[0])
+	if !ok {
+		say(botAPI, chatID, fmt.Sprintf("Unknown kind of replies %s, use one of: %s.",
+			fields[0], strings.Join(chatReplyKeys, ", ")))
+		return
+	}
+	text := strings.TrimSpace(args[len(fields[0]):])
+	if utf8.RuneCountInString(text) > maxChatReplyLength {
+		say(botAPI, chatID, fmt.Sprintf("The phrase is too long, it may have up to %d characters.", maxChatReplyLength))
+		return
+	}
+	if _, err := newChatPhrase(text); err != nil {
+		say(botAPI, chatID, fmt.Sprintf("Can't add the phrase: %s", err))
+		return
+	}
+
+	err := dbChats.Update(chatID, func(conf *ChatConfig) error {
+		pool := conf.Replies[key]
+		if len(pool) >= maxChatReplies {
+			return fmt.Errorf("the chat already has %d %s replies", maxChatReplies, key)
+		}
+		conf.Replies = withChatReplies(*conf, key, append(append([]string{}, pool...), text))
+		return nil
+	})
+	if err != nil {
+		Log.Warn("Can't add reply", "chat_id", chatID, "error", err)
+		say(botAPI, chatID, fmt.Sprintf("Can't add the phrase: %s", err))
+		return
+	}
+	Log.Info("Reply added", "chat_id", chatID, "key", key)
+	say(botAPI, chatID, fmt.Sprintf("Added the %s reply. See all of them with /listreplies.", key))
+}
+
+// listReplies shows phrases of the chat numbered as /delreply takes them.
+func (b bot) listReplies(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+	conf, ok := chatRepliesAdmin(dbChats, update, botAPI)
+	if !ok {
+		return
+	}
+
+	if len(conf.Replies) == 0 {
+		say(botAPI, chatID, "The chat has no replies of its own. Add one with /addreply.")
+		return
+	}
+	mode := "mixed with common ones, reply with them only using /settings ownReplies 1"
+	if b.opts().settingsOf(conf).OwnReplies != 0 {
+		mode = "used instead of common ones, mix them using /settings ownReplies 0"
+	}
+	lines := []string{fmt.Sprintf("Replies of the chat, %s.", mode)}
+	for _, key := range chatReplyKeys {
+		if len(conf.Replies[key]) == 0 {
+			continue
+		}
+		lines = append(lines, "", key+":")
+		for i, text := range conf.Replies[key] {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, text))
+		}
+	}
+	lines = append(lines, "", "Remove one with /delreply <kind> <number>.")
+	say(botAPI, chatID, strings.Join(lines, "\n"))
+}
+
+// delReply removes a phrase of the chat, given `<text|photo> <number>` arguments.
+func (b bot) delReply(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+	if _, ok := chatRepliesAdmin(dbChats, update, botAPI); !ok {
+		return
+	}
+
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) != 2 {
+		say(botAPI, chatID, fmt.Sprintf("Usage: /delreply <%s> <number>", strings.Join(chatReplyKeys, "|")))
+		return
+	}
+	key, ok := replyKey(args[0])
+	if !ok {
+		say(botAPI, chatID, fmt.Sprintf("Unknown kind of replies %s, use one of: %s.",
+			args[0], strings.Join(chatReplyKeys, ", ")))
+		return
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil {
+		say(botAPI, chatID, fmt.Sprintf("%s is not a number", args[1]))
+		return
+	}
+
+	var removed string
+	err = dbChats.Update(chatID, func(conf *ChatConfig) error {
+		pool := conf.Replies[key]
+		if n < 1 || n > len(pool) {
+			return fmt.Errorf("there is no %s reply #%d", key, n)
+		}
+		removed = pool[n-1]
+		next := append(append([]string{}, pool[:n-1]...), pool[n:]...)
+		conf.Replies = withChatReplies(*conf, key, next)
+		return nil
+	})
+	if err != nil {
+		Log.Warn("Can't remove reply", "chat_id", chatID, "error", err)
+		say(botAPI, chatID, fmt.Sprintf("Can't remove the phrase: %s", err))
+		return
+	}
+	Log.Info("Reply removed", "chat_id", chatID, "key", key)
+	say(botAPI, chatID, fmt.Sprintf("Removed the %s reply: %s", key, removed))
+}
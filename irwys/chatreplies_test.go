@@ -0,0 +1,120 @@
+package irwys
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func TestChatReplies(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1031, Type: "group"}
+	member := &tgbotapi.User{ID: 43, FirstName: "Member"}
+	env.fake.SetAdmin(chat.ID, testUser.ID)
+
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+
+	env.fake.Post(chat, member, "/addreply text not an admin")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Only chat administrators") {
+		t.Fatalf("Reply %q doesn't reject a non-admin", msg.Text)
+	}
+	env.fake.Post(chat, testUser, "/addreply video wow")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Unknown kind of replies video") {
+		t.Fatalf("Reply %q doesn't reject an unknown kind", msg.Text)
+	}
+	env.fake.Post(chat, testUser, "/addreply text {{.Nope}}")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Can't add the phrase") {
+		t.Fatalf("Reply %q doesn't reject a broken template", msg.Text)
+	}
+	env.fake.Post(chat, testUser, "/addreply text {{range 100000}}{{range 100000}}x{{end}}{{end}}")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "Can't add the phrase") {
+		t.Fatalf("Reply %q doesn't reject a range", msg.Text)
+	}
+
+	for _, cmd := range []string{
+		"/addreply text Our joke about {{.Author}}",
+		"/addreply text  Another   joke ",
+		"/addreply photo Our picture",
+	} {
+		env.fake.Post(chat, testUser, cmd)
+		if msg := env.expectSent(t); !strings.HasPrefix(msg.Text, "Added") {
+			t.Fatalf("Unexpected reply %q to %s", msg.Text, cmd)
+		}
+	}
+	conf, _, _ := env.dbChats.Get(chat.ID)
+	if got := conf.Replies[textReplies]; len(got) != 2 || got[1] != "Another   joke" {
+		t.Fatalf("Got text replies %q", got)
+	}
+
+	env.fake.Post(chat, testUser, "/listreplies")
+	msg := env.expectSent(t)
+	for _, want := range []string{"mixed with common ones", "text:\n1. Our joke about {{.Author}}\n2. Another   joke", "photo:\n1. Our picture"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Fatalf("List %q doesn't contain %q", msg.Text, want)
+		}
+	}
+
+	env.fake.Post(chat, testUser, "/delreply text 3")
+	if msg := env.expectSent(t); !strings.Contains(msg.Text, "there is no text reply #3") {
+		t.Fatalf("Reply %q doesn't reject a missing phrase", msg.Text)
+	}
+	env.fake.Post(chat, testUser, "/delreply text 2")
+	if msg := env.expectSent(t); msg.Text != "Removed the text reply: Another   joke" {
+		t.Fatalf("Unexpected reply %q", msg.Text)
+	}
+
+	// Replying with phrases of the chat only.
+	env.fake.Post(chat, testUser, "/settings ownReplies 1")
+	env.expectSent(t)
+	posted := env.fake.Post(chat, member, "something to remember later")
+	env.waitFor(t, "message to be remembered", func() bool {
+		ids := env.remembered(chat)
+		return len(ids) > 0 && ids[len(ids)-1] == posted.MessageID
+	})
+	env.dbMessages.Put(chat.ID, []MessageRef{newMessageRef(&posted)})
+	env.fake.Post(chat, testUser, "/recall")
+	env.expectSent(t)
+	if reply := env.expectSent(t); reply.Text != "Our joke about Member" {
+		t.Fatalf("Got reply %q, want the phrase of the chat", reply.Text)
+	}
+
+	env.fake.Post(chat, testUser, "/delreply photo 1")
+	env.expectSent(t)
+	env.fake.Post(chat, testUser, "/delreply text 1")
+	env.expectSent(t)
+	if conf, _, _ := env.dbChats.Get(chat.ID); conf.Replies != nil {
+		t.Fatalf("Replies left after removing all of them: %v", conf.Replies)
+	}
+}
+
+func TestNewChatPhrase(t *testing.T) {
+	for _, text := range []string{
+		"plain",
+		"{{.Author}} said it {{.Days}} days ago",
+		"{{if .Author}}{{.Author}}{{else}}someone{{end}} in {{.Chat}}",
+		"{{if .DateKnown}}{{.Years}}{{else if .Username}}@{{.Username}}{{end}}",
+	} {
+		if _, err := newChatPhrase(text); err != nil {
+			t.Errorf("%q rejected: %s", text, err)
+		}
+	}
+	for _, text := range []string{
+		"{{range 100000}}x{{end}}",
+		"{{with .Author}}{{.}}{{end}}",
+		`{{define "x"}}x{{end}}`,
+		`{{block "x" .}}x{{end}}`,
+		`{{template "x"}}`,
+		`{{printf "%s" .Author}}`,
+		"{{.Author | len}}",
+		`{{.Date.Format "2006"}}`,
+		"{{$a := .Author}}{{$a}}",
+		"{{.}}",
+		"{{if len .Author}}x{{end}}",
+	} {
+		if _, err := newChatPhrase(text); err == nil {
+			t.Errorf("%q accepted", text)
+		}
+	}
+}
@@ -1,14 +1,13 @@
 package irwys
 
 import (
-	"bytes"
-	"encoding/gob"
 	"path/filepath"
 	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -26,60 +25,53 @@ func NewDB(
 	name string,
 	opts *opt.Options,
 ) DB {
-	gob.Register(map[string]string{})
 	lock := sync.RWMutex{}
 	ldb, err := leveldb.OpenFile(filepath.Join(path, name), opts)
 	if err != nil {
-		Error.Println("Can't get access to database")
+		Log.Error("Can't get access to database", "path", filepath.Join(path, name), "error", err)
 		panic(err)
 	}
 	db := DB{ldb, new(leveldb.Batch), opts, &lock}
 	return db
 }
 
-// Get performs non-blocking get of an object from database.
-func (db DB) Get(key string) (decoded interface{}, err error) {
+// NewMemDB creates an object of DB structure kept in memory only.
+func NewMemDB() DB {
+	lock := sync.RWMutex{}
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		Log.Error("Can't create database in memory", "error", err)
+		panic(err)
+	}
+	db := DB{ldb, new(leveldb.Batch), nil, &lock}
+	return db
+}
+
+// Get performs non-blocking get of a raw value from database.
+// Returns nil value if there is no such key.
+func (db DB) Get(key string) (data []byte, err error) {
 	(*db.lock).RLock()
 	defer (*db.lock).RUnlock()
 
 	var ok bool
-	var data []byte
 
 	if ok, err = db.db.Has([]byte(key), nil); !ok {
 		return
 	}
 	if data, err = db.db.Get([]byte(key), nil); err != nil {
-		Error.Printf(
-			"Can't get entry from DB\n\tKey: %s\n\tError: %s",
-			key, err,
-		)
-	} else {
-		d := gob.NewDecoder(bytes.NewReader(data))
-		if err = d.Decode(&decoded); err != nil {
-			Error.Printf("Can't decode value:\n\tValue: %s\n\tError: %s", data, err)
-		}
+		Log.Error("Can't get entry from DB", "key", key, "error", err)
 	}
 
 	return
 }
 
-// Put performs non-blocking put of an object into database.
-func (db DB) Put(key string, value interface{}) (err error) {
+// Put performs non-blocking put of a raw value into database.
+func (db DB) Put(key string, data []byte) (err error) {
 	(*db.lock).Lock()
 	defer (*db.lock).Unlock()
 
-	b := new(bytes.Buffer)
-	e := gob.NewEncoder(b)
-
-	if err = e.Encode(&value); err != nil {
-		Error.Printf("Can't encode value:\n\tValue: %d\n\tError: %s", value, err)
-	}
-
-	if err = db.db.Put([]byte(key), b.Bytes(), nil); err != nil {
-		Error.Printf(
-			"Can't put entry to DB\n\tKey: %s\n\tValue: %d\n\tError: %s",
-			key, value, err,
-		)
+	if err = db.db.Put([]byte(key), data, nil); err != nil {
+		Log.Error("Can't put entry to DB", "key", key, "error", err)
 	}
 
 	return
@@ -91,10 +83,7 @@ func (db DB) Delete(key string) (err error) {
 	defer (*db.lock).Unlock()
 
 	if err = db.db.Delete([]byte(key), nil); err != nil {
-		Error.Printf(
-			"Can't delete entry from DB\n\tKey: %s\n\tError: %s",
-			key, err,
-		)
+		Log.Error("Can't delete entry from DB", "key", key, "error", err)
 	}
 
 	return
@@ -106,21 +95,18 @@ func (db DB) Exist(key string) (exist bool, err error) {
 	defer (*db.lock).RUnlock()
 
 	if exist, err = db.db.Has([]byte(key), nil); err != nil {
-		Error.Printf(
-			"Can't find entry in DB\n\tKey: %s\n\tError: %s",
-			key, err,
-		)
+		Log.Error("Can't find entry in DB", "key", key, "error", err)
 	}
 
 	return
 }
 
 // BatchPut puts objects into the database by batching (leveldb).
-func (db DB) BatchPut(key string, value string) {
+func (db DB) BatchPut(key string, data []byte) {
 	(*db.lock).Lock()
 	defer (*db.lock).Unlock()
 
-	db.batch.Put([]byte(key), []byte(value))
+	db.batch.Put([]byte(key), data)
 }
 
 // BatchDelete deletes objects from the database by batching (leveldb).
@@ -134,7 +120,7 @@ func (db DB) BatchDelete(key string) {
 // BatchWrite performs write of batch to database.
 func (db DB) BatchWrite() (err error) {
 	if err = db.db.Write(db.batch, nil); err != nil {
-		Error.Printf("Can't write batch to DB\n\tError: %s", err)
+		Log.Error("Can't write batch to DB", "error", err)
 	}
 	db.batch.Reset()
 
@@ -146,6 +132,17 @@ func (db DB) Iterate(opts *util.Range) iterator.Iterator {
 	return db.db.NewIterator(opts, nil)
 }
 
+// Compact compacts the whole database, reclaiming space of deleted and overwritten entries.
+func (db DB) Compact() error {
+	return db.db.CompactRange(util.Range{})
+}
+
+// Stats returns statistics of the database.
+func (db DB) Stats() (stats leveldb.DBStats, err error) {
+	err = db.db.Stats(&stats)
+	return
+}
+
 // Close DB connection
 func (db DB) Close() {
 	db.db.Close()
@@ -0,0 +1,221 @@
+package irwys
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+type fakeKey struct {
+	chatID int64
+	id     int
+}
+
+// FakeMessenger structure.
+// Implements Messenger in memory so the bot can run without Telegram.
+// Messages posted through it and sent by the bot are kept in a history,
+// so forwarding behaves like it does against the real API.
+type FakeMessenger struct {
+	self     tgbotapi.User
+	updates  chan tgbotapi.Update
+	outbox   chan tgbotapi.Message
+	history  map[fakeKey]tgbotapi.Message
+	admins   map[fakeKey]bool
+	answers  chan tgbotapi.CallbackConfig
+	nextID   int
+	updateID int
+	lock     *sync.Mutex
+}
+
+// NewFakeMessenger creates an object of FakeMessenger structure.
+func NewFakeMessenger(self tgbotapi.User) *FakeMessenger {
+	lock := sync.Mutex{}
+	m := FakeMessenger{
+		self:    self,
+		updates: make(chan tgbotapi.Update, 64),
+		outbox:  make(chan tgbotapi.Message, 1024),
+		history: map[fakeKey]tgbotapi.Message{},
+		admins:  map[fakeKey]bool{},
+		answers: make(chan tgbotapi.CallbackConfig, 64),
+		lock:    &lock,
+	}
+	return &m
+}
+
+// Self returns the bot account.
+func (m *FakeMessenger) Self() tgbotapi.User {
+	return m.self
+}
+
+// Send records a message sent by the bot.
+func (m *FakeMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+
+	switch c := c.(type) {
+	case tgbotapi.ForwardConfig:
+		return m.Forward(c.ChatID, c.FromChatID, c.MessageID)
+	case tgbotapi.MessageConfig:
+		msg = tgbotapi.Message{Chat: &tgbotapi.Chat{ID: c.ChatID}, Text: c.Text}
+	case tgbotapi.EditMessageTextConfig:
+		m.lock.Lock()
+		orig, ok := m.history[fakeKey{c.ChatID, c.MessageID}]
+		if ok {
+			orig.Text = c.Text
+			m.history[fakeKey{c.ChatID, c.MessageID}] = orig
+		}
+		m.lock.Unlock()
+		if !ok {
+			return msg, tgbotapi.Error{Message: "Bad Request: message to edit not found"}
+		}
+		m.outbox <- orig
+		return orig, nil
+	case tgbotapi.PhotoConfig:
+		msg = tgbotapi.Message{
+			Chat:    &tgbotapi.Chat{ID: c.ChatID},
+			Photo:   &[]tgbotapi.PhotoSize{{FileID: c.FileID}},
+			Caption: c.Caption,
+		}
+	default:
+		return msg, tgbotapi.Error{Message: "Bad Request: unsupported request"}
+	}
+
+	return m.store(msg), nil
+}
+
+// Forward forwards a message from the history.
+func (m *FakeMessenger) Forward(chatID int64, fromChatID int64, messageID int) (tgbotapi.Message, error) {
+	m.lock.Lock()
+	orig, ok := m.history[fakeKey{fromChatID, messageID}]
+	m.lock.Unlock()
+	if !ok {
+		return tgbotapi.Message{}, tgbotapi.Error{Message: "Bad Request: message to forward not found"}
+	}
+
+	msg := orig
+	msg.Chat = &tgbotapi.Chat{ID: chatID}
+	msg.ForwardFrom = orig.From
+	msg.ForwardFromMessageID = orig.MessageID
+	msg.ForwardDate = orig.Date
+
+	return m.store(msg), nil
+}
+
+// Updates returns the channel messages posted to the fake are delivered to.
+func (m *FakeMessenger) Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	return m.updates, nil
+}
+
+// ChatMember reports the user as an administrator of the chat if SetAdmin was called for them,
+// and as a regular member otherwise.
+func (m *FakeMessenger) ChatMember(chatID int64, userID int) (tgbotapi.ChatMember, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	member := tgbotapi.ChatMember{User: &tgbotapi.User{ID: userID}, Status: "member"}
+	if m.admins[fakeKey{chatID, userID}] {
+		member.Status = "administrator"
+	}
+	return member, nil
+}
+
+// AnswerCallback records the answer to a callback query.
+func (m *FakeMessenger) AnswerCallback(queryID string, text string) error {
+	m.answers <- tgbotapi.NewCallback(queryID, text)
+	return nil
+}
+
+// SetAdmin makes the user an administrator of the chat.
+func (m *FakeMessenger) SetAdmin(chatID int64, userID int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.admins[fakeKey{chatID, userID}] = true
+}
+
+// Press delivers a press on an inline keyboard button attached to the message.
+func (m *FakeMessenger) Press(msg tgbotapi.Message, from *tgbotapi.User, data string) {
+	m.lock.Lock()
+	m.updateID++
+	update := tgbotapi.Update{
+		UpdateID: m.updateID,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      strconv.Itoa(m.updateID),
+			From:    from,
+			Message: &msg,
+			Data:    data,
+		},
+	}
+	m.lock.Unlock()
+
+	m.updates <- update
+}
+
+// Answers returns the channel of answers to callback queries.
+func (m *FakeMessenger) Answers() <-chan tgbotapi.CallbackConfig {
+	return m.answers
+}
+
+// Post delivers a text message to the bot as if a user wrote it in the chat.
+// Text starting with a slash is marked as a bot command.
+func (m *FakeMessenger) Post(chat *tgbotapi.Chat, from *tgbotapi.User, text string) tgbotapi.Message {
+	msg := tgbotapi.Message{Chat: chat, From: from, Text: text}
+	if strings.HasPrefix(text, "/") {
+		l := strings.Index(text, " ")
+		if l < 0 {
+			l = len(text)
+		}
+		msg.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: l}}
+	}
+
+	return m.Deliver(msg)
+}
+
+// Deliver delivers an arbitrary message to the bot, assigning its ID and date.
+func (m *FakeMessenger) Deliver(msg tgbotapi.Message) tgbotapi.Message {
+	m.lock.Lock()
+	m.nextID++
+	m.updateID++
+	msg.MessageID = m.nextID
+	if msg.Date == 0 {
+		msg.Date = int(time.Now().Unix())
+	}
+	m.history[fakeKey{msg.Chat.ID, msg.MessageID}] = msg
+	update := tgbotapi.Update{UpdateID: m.updateID, Message: &msg}
+	m.lock.Unlock()
+
+	m.updates <- update
+	return msg
+}
+
+// Delete removes a message from the history, so it can't be forwarded anymore.
+func (m *FakeMessenger) Delete(chatID int64, messageID int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.history, fakeKey{chatID, messageID})
+}
+
+// Sent returns the channel of messages sent by the bot.
+func (m *FakeMessenger) Sent() <-chan tgbotapi.Message {
+	return m.outbox
+}
+
+// Close stops delivering updates to the bot.
+func (m *FakeMessenger) Close() {
+	close(m.updates)
+}
+
+func (m *FakeMessenger) store(msg tgbotapi.Message) tgbotapi.Message {
+	m.lock.Lock()
+	m.nextID++
+	msg.MessageID = m.nextID
+	msg.From = &m.self
+	msg.Date = int(time.Now().Unix())
+	m.history[fakeKey{msg.Chat.ID, msg.MessageID}] = msg
+	m.lock.Unlock()
+
+	m.outbox <- msg
+	return msg
+}
@@ -0,0 +1,112 @@
+package irwys
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// contact structure.
+// Keeps the time Telegram was last reached, safe for concurrent use.
+type contact struct {
+	nanos int64
+}
+
+func (c *contact) touch() {
+	atomic.StoreInt64(&c.nanos, time.Now().UnixNano())
+}
+
+// time returns the last time Telegram was reached, zero if never.
+func (c *contact) time() time.Time {
+	nanos := atomic.LoadInt64(&c.nanos)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// staleContact is the time since Telegram was last reached after which the bot isn't ready.
+// Telegram is reached at least every pollTimeout, by polling or by checking the webhook.
+const staleContact = 3 * pollTimeout
+
+// contacter is implemented by messengers knowing when Telegram was last reached,
+// even if it had no updates to deliver.
+type contacter interface {
+	LastContact() time.Time
+}
+
+// healthReport is the body of health and readiness responses.
+type healthReport struct {
+	Status  string `json:"status"`
+	Storage string `json:"storage"`
+	// LastContact is the number of seconds since Telegram was last reached, -1 if never.
+	LastContact float64 `json:"last_contact_seconds"`
+	Sessions    int     `json:"sessions"`
+}
+
+// health structure.
+// Reports if the storage is open, when Telegram was last reached and how many chats are watched.
+type health struct {
+	store    Store
+	sessions *sessions
+	// stale is the time since the last contact after which Telegram isn't considered reached.
+	stale    time.Duration
+	contacts []func() time.Time
+}
+
+// newHealth creates an object of health structure.
+// Telegram is considered reached at the latest of times returned by contacts, unless it's stale.
+func newHealth(store Store, sessions *sessions, stale time.Duration, contacts ...func() time.Time) *health {
+	h := health{store, sessions, stale, contacts}
+	return &h
+}
+
+func (h *health) report() (r healthReport, storageOK bool, reached bool) {
+	r.Storage = "open"
+	if _, err := h.store.Chats().Exist(0); err != nil {
+		r.Storage = err.Error()
+	} else {
+		storageOK = true
+	}
+
+	var last time.Time
+	for _, c := range h.contacts {
+		if t := c(); t.After(last) {
+			last = t
+		}
+	}
+	r.LastContact = -1
+	if !last.IsZero() {
+		since := time.Since(last)
+		r.LastContact = since.Seconds()
+		reached = since < h.stale
+	}
+
+	r.Sessions = h.sessions.Len()
+	return
+}
+
+func writeReport(w http.ResponseWriter, r healthReport, ok bool) {
+	r.Status = "ok"
+	code := http.StatusOK
+	if !ok {
+		r.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(r)
+}
+
+// healthz reports the bot is alive as long as its storage is open.
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	report, storageOK, _ := h.report()
+	writeReport(w, report, storageOK)
+}
+
+// readyz reports the bot is ready while its storage is open and Telegram has been reached lately.
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	report, storageOK, reached := h.report()
+	writeReport(w, report, storageOK && reached)
+}
@@ -0,0 +1,87 @@
+package irwys
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func checkHealth(t *testing.T, handler http.HandlerFunc, wantCode int) healthReport {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Can't decode %q: %s", rec.Body.String(), err)
+	}
+	if rec.Code != wantCode {
+		t.Fatalf("Got status %d (%+v), want %d", rec.Code, report, wantCode)
+	}
+	return report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	env := newTestEnv(t)
+	h := env.b.health(env.store, env.fake)
+
+	// Telegram hasn't been reached yet.
+	if r := checkHealth(t, h.healthz, http.StatusOK); r.Storage != "open" || r.LastContact != -1 {
+		t.Fatalf("Got %+v, want open storage and no contact", r)
+	}
+	checkHealth(t, h.readyz, http.StatusServiceUnavailable)
+
+	chat := &tgbotapi.Chat{ID: 1020, Type: "group"}
+	env.fake.Post(chat, testUser, "/start")
+	env.expectSent(t)
+	env.waitFor(t, "chat to be watched", func() bool { return env.b.sessions.Exist(chat.ID) })
+
+	r := checkHealth(t, h.readyz, http.StatusOK)
+	if r.Status != "ok" || r.Sessions != 1 || r.LastContact < 0 || r.LastContact > 2 {
+		t.Fatalf("Got %+v, want a recent contact and 1 session", r)
+	}
+
+	env.store.Close()
+	if r := checkHealth(t, h.healthz, http.StatusServiceUnavailable); r.Storage == "open" {
+		t.Fatalf("Got %+v, want closed storage", r)
+	}
+	checkHealth(t, h.readyz, http.StatusServiceUnavailable)
+}
+
+func TestReadyzStaleContact(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+	last := time.Now().Add(-time.Minute)
+	h := newHealth(store, newSessions(), 2*time.Minute, func() time.Time { return last })
+
+	checkHealth(t, h.readyz, http.StatusOK)
+
+	last = time.Now().Add(-3 * time.Minute)
+	r := checkHealth(t, h.readyz, http.StatusServiceUnavailable)
+	if r.LastContact < 180 {
+		t.Fatalf("Got %+v, want the last contact 3 minutes ago", r)
+	}
+	// The bot is still alive, it just can't reach Telegram.
+	checkHealth(t, h.healthz, http.StatusOK)
+}
+
+func TestWebhookTouchesContact(t *testing.T) {
+	hook := newWebhookHandler("/hook", "secret")
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	if !hook.contact.time().IsZero() {
+		t.Fatal("Contact is touched before any update")
+	}
+	if code := postUpdate(t, srv, "/hook", "secret", recordedStart); code != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", code)
+	}
+	<-hook.updates
+	if hook.contact.time().IsZero() {
+		t.Fatal("Contact isn't touched by a delivered update")
+	}
+}
@@ -0,0 +1,67 @@
+package irwys
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// Log formats selectable by name.
+const (
+	TextLog = "text"
+	JSONLog = "json"
+)
+
+// LogFormats lists log formats selectable by name.
+var LogFormats = []string{TextLog, JSONLog}
+
+// LogLevels lists log levels selectable by name, most verbose first.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// textKey is the key of message text in log events, which is omitted if logs are redacted.
+const textKey = "text"
+
+// Log is the logger of the package. It discards events until Init is called.
+var Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Init makes Log write events of the level and above to w in the format,
+// either logfmt-like text or JSON lines. Message text is left out if redact is set.
+// It's called once on start, reloads leave logging as it is.
+func Init(w io.Writer, format string, level string, redact bool) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if redact {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == textKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	switch format {
+	case TextLog:
+		Log = slog.New(slog.NewTextHandler(w, opts))
+	case JSONLog:
+		Log = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// chatLog returns the logger adding the chat to events.
+func chatLog(chatID int64) *slog.Logger {
+	return Log.With("chat_id", chatID)
+}
+
+// messageLog returns the logger adding the chat and the message to events.
+func messageLog(msg *tgbotapi.Message) *slog.Logger {
+	return Log.With("chat_id", msg.Chat.ID, "message_id", msg.MessageID)
+}
@@ -0,0 +1,47 @@
+package irwys
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func TestLogging(t *testing.T) {
+	defer func() { Log = slog.New(slog.DiscardHandler) }()
+	msg := &tgbotapi.Message{MessageID: 7, Chat: &tgbotapi.Chat{ID: -100}, Text: "a secret"}
+
+	buf := new(bytes.Buffer)
+	if err := Init(buf, JSONLog, "info", false); err != nil {
+		t.Fatal(err)
+	}
+	messageLog(msg).Debug("Hidden by level")
+	messageLog(msg).Info("Received message", textKey, msg.Text)
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("Got %q, want a single JSON event: %s", buf.String(), err)
+	}
+	if event["level"] != "INFO" || event["chat_id"] != -100.0 || event["message_id"] != 7.0 || event["text"] != "a secret" {
+		t.Fatalf("Got event %v", event)
+	}
+
+	buf.Reset()
+	if err := Init(buf, TextLog, "debug", true); err != nil {
+		t.Fatal(err)
+	}
+	messageLog(msg).Debug("Received message", textKey, msg.Text)
+	if got := buf.String(); !strings.Contains(got, "chat_id=-100 message_id=7") || strings.Contains(got, "secret") {
+		t.Fatalf("Got %q, want chat and message without text", got)
+	}
+
+	if err := Init(buf, "xml", "info", false); err == nil {
+		t.Fatal("Accepted unknown format")
+	}
+	if err := Init(buf, TextLog, "loud", false); err == nil {
+		t.Fatal("Accepted unknown level")
+	}
+}
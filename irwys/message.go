@@ -0,0 +1,147 @@
+package irwys
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// Message types of remembered messages.
+const (
+	messageText      = "text"
+	messagePhoto     = "photo"
+	messageVideo     = "video"
+	messageAnimation = "animation"
+	messageDocument  = "document"
+	messageAudio     = "audio"
+	messageVoice     = "voice"
+	messageSticker   = "sticker"
+)
+
+var messageTypes = []string{
+	messageText, messagePhoto, messageVideo, messageAnimation,
+	messageDocument, messageAudio, messageVoice, messageSticker,
+}
+
+// isMessageType checks if t is a type of remembered messages.
+func isMessageType(t string) bool {
+	return containsString(messageTypes, t)
+}
+
+// newMessageRef captures content and metadata of a message.
+func newMessageRef(msg *tgbotapi.Message) MessageRef {
+	ref := MessageRef{
+		ID:   msg.MessageID,
+		Date: int64(msg.Date),
+		Type: messageText,
+		Text: msg.Text,
+	}
+	if msg.From != nil {
+		ref.AuthorID = msg.From.ID
+		ref.Author = msg.From.UserName
+		ref.AuthorName = strings.TrimSpace(msg.From.FirstName + " " + msg.From.LastName)
+	}
+	if msg.ReplyToMessage != nil {
+		ref.ReplyToID = msg.ReplyToMessage.MessageID
+	}
+	if msg.Caption != "" {
+		ref.Text = msg.Caption
+	}
+
+	switch {
+	case msg.Photo != nil:
+		ref.Type = messagePhoto
+		for _, p := range *msg.Photo {
+			ref.FileIDs = append(ref.FileIDs, p.FileID)
+		}
+	case msg.Video != nil:
+		ref.Type = messageVideo
+		ref.FileIDs = []string{msg.Video.FileID}
+	case msg.Animation != nil:
+		ref.Type = messageAnimation
+		ref.FileIDs = []string{msg.Animation.FileID}
+	case msg.Document != nil:
+		ref.Type = messageDocument
+		ref.FileIDs = []string{msg.Document.FileID}
+	case msg.Audio != nil:
+		ref.Type = messageAudio
+		ref.FileIDs = []string{msg.Audio.FileID}
+	case msg.Voice != nil:
+		ref.Type = messageVoice
+		ref.FileIDs = []string{msg.Voice.FileID}
+	case msg.Sticker != nil:
+		ref.Type = messageSticker
+		ref.FileIDs = []string{msg.Sticker.FileID}
+	}
+
+	return ref
+}
+
+// Time returns when the message was posted.
+func (ref MessageRef) Time() time.Time {
+	return time.Unix(ref.Date, 0)
+}
+
+// signature names the author of the message for reposts.
+func (ref MessageRef) signature() string {
+	switch {
+	case ref.Author != "":
+		return "@" + ref.Author
+	case ref.AuthorName != "":
+		return ref.AuthorName
+	}
+	return ""
+}
+
+// repost posts content of a remembered message again,
+// for the cases the original can't be forwarded.
+func repost(botAPI Messenger, chatID int64, ref MessageRef) (tgbotapi.Message, error) {
+	caption := ref.Text
+	if s := ref.signature(); s != "" {
+		caption = strings.TrimSpace(fmt.Sprintf("%s\n\n— %s", ref.Text, s))
+	}
+
+	var fileID string
+	if len(ref.FileIDs) > 0 {
+		// Photo sizes are ordered from the smallest to the largest.
+		fileID = ref.FileIDs[len(ref.FileIDs)-1]
+	}
+
+	var c tgbotapi.Chattable
+	switch ref.Type {
+	case messageText:
+		c = tgbotapi.NewMessage(chatID, caption)
+	case messagePhoto:
+		p := tgbotapi.NewPhotoShare(chatID, fileID)
+		p.Caption = caption
+		c = p
+	case messageVideo:
+		v := tgbotapi.NewVideoShare(chatID, fileID)
+		v.Caption = caption
+		c = v
+	case messageAnimation:
+		a := tgbotapi.NewAnimationShare(chatID, fileID)
+		a.Caption = caption
+		c = a
+	case messageDocument:
+		d := tgbotapi.NewDocumentShare(chatID, fileID)
+		d.Caption = caption
+		c = d
+	case messageAudio:
+		a := tgbotapi.NewAudioShare(chatID, fileID)
+		a.Caption = caption
+		c = a
+	case messageVoice:
+		v := tgbotapi.NewVoiceShare(chatID, fileID)
+		v.Caption = caption
+		c = v
+	case messageSticker:
+		c = tgbotapi.NewStickerShare(chatID, fileID)
+	default:
+		return tgbotapi.Message{}, fmt.Errorf("no content stored for message %d", ref.ID)
+	}
+
+	return botAPI.Send(c)
+}
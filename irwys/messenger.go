@@ -0,0 +1,121 @@
+package irwys
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// Messenger is the set of Telegram operations the bot depends on.
+type Messenger interface {
+	// Self returns the account the messenger acts on behalf of.
+	Self() tgbotapi.User
+	// Send sends any Telegram request that results in a message.
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	// Forward forwards a message from one chat to another.
+	Forward(chatID int64, fromChatID int64, messageID int) (tgbotapi.Message, error)
+	// Updates starts receiving updates and returns the channel they are delivered to.
+	// Receiving stops once ctx is done.
+	Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error)
+	// ChatMember returns membership information of a user in a chat.
+	ChatMember(chatID int64, userID int) (tgbotapi.ChatMember, error)
+	// AnswerCallback acknowledges a press on an inline keyboard button.
+	AnswerCallback(queryID string, text string) error
+}
+
+// pollRetryDelay is the time long polling waits for after a failed request.
+const pollRetryDelay = 3 * time.Second
+
+// pollTimeout is the time Telegram holds a long polling request for if there are no updates.
+const pollTimeout = 60 * time.Second
+
+// telegramMessenger structure.
+// Implements Messenger on top of the Telegram Bot API.
+type telegramMessenger struct {
+	api     *tgbotapi.BotAPI
+	contact *contact
+}
+
+// NewTelegramMessenger creates a Messenger authenticated with the given token.
+func NewTelegramMessenger(token string) (Messenger, error) {
+	api, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	return telegramMessenger{api, &contact{}}, nil
+}
+
+// Self returns the bot account.
+func (m telegramMessenger) Self() tgbotapi.User {
+	return m.api.Self
+}
+
+// Send sends a Chattable item to Telegram.
+func (m telegramMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return m.api.Send(c)
+}
+
+// Forward forwards a message via Telegram.
+func (m telegramMessenger) Forward(chatID int64, fromChatID int64, messageID int) (tgbotapi.Message, error) {
+	return m.api.Send(tgbotapi.NewForward(chatID, fromChatID, messageID))
+}
+
+// Updates starts long polling of Telegram updates, removing the webhook set by a previous run if any,
+// as Telegram refuses to serve updates by polling while a webhook is set.
+// The channel is closed once ctx is done.
+func (m telegramMessenger) Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	if _, err := m.api.RemoveWebhook(); err != nil {
+		return nil, fmt.Errorf("can't remove webhook: %s", err)
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = int(pollTimeout / time.Second)
+
+	ch := make(chan tgbotapi.Update, m.api.Buffer)
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			updates, err := m.api.GetUpdates(u)
+			if err != nil {
+				Log.Warn("Can't get updates, retrying", "delay", pollRetryDelay, "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(pollRetryDelay):
+				}
+				continue
+			}
+			m.contact.touch()
+
+			for _, update := range updates {
+				if update.UpdateID < u.Offset {
+					continue
+				}
+				u.Offset = update.UpdateID + 1
+				select {
+				case ch <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// LastContact returns the time Telegram was last reached.
+func (m telegramMessenger) LastContact() time.Time {
+	return m.contact.time()
+}
+
+// ChatMember gets a chat member from Telegram.
+func (m telegramMessenger) ChatMember(chatID int64, userID int) (tgbotapi.ChatMember, error) {
+	return m.api.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID})
+}
+
+// AnswerCallback answers a callback query via Telegram.
+func (m telegramMessenger) AnswerCallback(queryID string, text string) error {
+	_, err := m.api.AnswerCallbackQuery(tgbotapi.NewCallback(queryID, text))
+	return err
+}
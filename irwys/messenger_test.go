@@ -0,0 +1,81 @@
+package irwys
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// recordingTransport answers Bot API requests with canned bodies and records the called methods.
+type recordingTransport struct {
+	lock    sync.Mutex
+	methods []string
+	answers map[string]string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := path.Base(req.URL.Path)
+	t.lock.Lock()
+	t.methods = append(t.methods, method)
+	t.lock.Unlock()
+
+	body, ok := t.answers[method]
+	if !ok {
+		body = `{"ok":true,"result":[]}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func (t *recordingTransport) called() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]string(nil), t.methods...)
+}
+
+func TestUpdatesRemovesWebhook(t *testing.T) {
+	transport := &recordingTransport{answers: map[string]string{}}
+	api := &tgbotapi.BotAPI{Token: "token", Client: &http.Client{Transport: transport}}
+	m := telegramMessenger{api, &contact{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := m.Updates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range ch {
+	}
+
+	methods := transport.called()
+	if len(methods) == 0 || methods[0] != "setWebhook" {
+		t.Fatalf("expected setWebhook to be called first, got %v", methods)
+	}
+}
+
+func TestUpdatesFailsIfWebhookStays(t *testing.T) {
+	transport := &recordingTransport{answers: map[string]string{
+		"setWebhook": `{"ok":false,"error_code":401,"description":"Unauthorized"}`,
+	}}
+	api := &tgbotapi.BotAPI{Token: "token", Client: &http.Client{Transport: transport}}
+	m := telegramMessenger{api, &contact{}}
+
+	if _, err := m.Updates(context.Background()); err == nil {
+		t.Fatal("expected an error when the webhook can't be removed")
+	}
+	for _, method := range transport.called() {
+		if method == "getUpdates" {
+			t.Fatal("polling started although the webhook wasn't removed")
+		}
+	}
+}
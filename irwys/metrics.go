@@ -0,0 +1,256 @@
+package irwys
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+const metricsPrefix = "irwys_"
+
+// Reasons a recall fails for.
+const (
+	recallNoMessages   = "no_messages"
+	recallStorageError = "storage_error"
+	recallNotForwarded = "not_forwarded"
+)
+
+// counter structure.
+// Counts events, optionally split by the value of a single label.
+type counter struct {
+	name   string
+	help   string
+	label  string
+	values map[string]int64
+	lock   *sync.Mutex
+}
+
+// newCounter creates an object of counter structure.
+// Counts aren't split if label is empty.
+func newCounter(name string, help string, label string) *counter {
+	lock := sync.Mutex{}
+	c := counter{metricsPrefix + name, help, label, map[string]int64{}, &lock}
+	return &c
+}
+
+// Inc counts an event with the given label value, which is ignored if counts aren't split.
+func (c *counter) Inc(value string) {
+	if c.label == "" {
+		value = ""
+	}
+
+	(*c.lock).Lock()
+	c.values[value]++
+	(*c.lock).Unlock()
+}
+
+// Get returns the count of events with the given label value.
+func (c *counter) Get(value string) int64 {
+	(*c.lock).Lock()
+	defer (*c.lock).Unlock()
+
+	return c.values[value]
+}
+
+func (c *counter) write(w io.Writer) {
+	(*c.lock).Lock()
+	defer (*c.lock).Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return
+	}
+
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, v, c.values[v])
+	}
+}
+
+// metrics structure.
+// Counts what the bot does, exposed in the Prometheus text format.
+type metrics struct {
+	updates    *counter
+	remembered *counter
+	attempted  *counter
+	succeeded  *counter
+	failed     *counter
+	apiErrors  *counter
+	reloads    *counter
+}
+
+// newMetrics creates an object of metrics structure.
+func newMetrics() *metrics {
+	m := metrics{
+		updates:    newCounter("updates_total", "Updates received from Telegram.", "type"),
+		remembered: newCounter("messages_remembered_total", "Messages remembered.", ""),
+		attempted:  newCounter("recalls_attempted_total", "Recalls attempted.", ""),
+		succeeded:  newCounter("recalls_succeeded_total", "Recalls that forwarded or reposted a message.", ""),
+		failed:     newCounter("recalls_failed_total", "Recalls that failed.", "reason"),
+		apiErrors:  newCounter("telegram_api_errors_total", "Failed Telegram API requests.", "method"),
+		reloads:    newCounter("reloads_total", "Reloads of options and reply dictionaries.", "result"),
+	}
+	return &m
+}
+
+func (m *metrics) counters() []*counter {
+	return []*counter{m.updates, m.remembered, m.attempted, m.succeeded, m.failed, m.apiErrors, m.reloads}
+}
+
+// updateType names the kind of the update.
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	}
+	return "other"
+}
+
+// metricName turns a storage figure into a metric name.
+func metricName(name string) string {
+	return metricsPrefix + "storage_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+// write writes counters, numbers of messages remembered per chat and storage figures to w.
+func (m *metrics) write(store Store, w io.Writer) error {
+	for _, c := range m.counters() {
+		c.write(w)
+	}
+
+	counts, err := store.Messages().Counts()
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	name := metricsPrefix + "chat_messages"
+	fmt.Fprintf(w, "# HELP %s Messages remembered per chat.\n# TYPE %s gauge\n", name, name)
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s{chat_id=\"%d\"} %d\n", name, id, counts[id])
+	}
+
+	stats, err := storeStats(store, counts)
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		name := metricName(s.Name)
+		fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", name, name, s.Value)
+	}
+	return nil
+}
+
+// handler serves metrics of the bot and the storage.
+func (m *metrics) handler(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(strings.Builder)
+		if err := m.write(store, buf); err != nil {
+			Log.Error("Can't collect metrics", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, buf.String())
+	})
+}
+
+// countingMessenger structure.
+// Counts failed requests of the wrapped Messenger.
+type countingMessenger struct {
+	Messenger
+	errors *counter
+}
+
+func (m countingMessenger) count(method string, err error) {
+	if err != nil {
+		m.errors.Inc(method)
+	}
+}
+
+func (m countingMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, err := m.Messenger.Send(c)
+	m.count("send", err)
+	return msg, err
+}
+
+func (m countingMessenger) Forward(chatID int64, fromChatID int64, messageID int) (tgbotapi.Message, error) {
+	msg, err := m.Messenger.Forward(chatID, fromChatID, messageID)
+	m.count("forward", err)
+	return msg, err
+}
+
+func (m countingMessenger) Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	updates, err := m.Messenger.Updates(ctx)
+	m.count("updates", err)
+	return updates, err
+}
+
+func (m countingMessenger) ChatMember(chatID int64, userID int) (tgbotapi.ChatMember, error) {
+	member, err := m.Messenger.ChatMember(chatID, userID)
+	m.count("chat_member", err)
+	return member, err
+}
+
+func (m countingMessenger) AnswerCallback(queryID string, text string) error {
+	err := m.Messenger.AnswerCallback(queryID, text)
+	m.count("answer_callback", err)
+	return err
+}
+
+// adminShutdownTimeout limits the time requests in progress are waited for on shutdown.
+const adminShutdownTimeout = 5 * time.Second
+
+// serveAdmin serves the handler on the address until ctx is done.
+func serveAdmin(ctx context.Context, addr string, h http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: h}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			Log.Error("Admin server stopped", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			Log.Error("Can't stop admin server", "error", err)
+		}
+	}()
+	return nil
+}
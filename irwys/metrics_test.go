@@ -0,0 +1,60 @@
+package irwys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	chat := &tgbotapi.Chat{ID: 1017, Type: "group"}
+	empty := &tgbotapi.Chat{ID: 1018, Type: "group"}
+	deleted := &tgbotapi.Chat{ID: 1019, Type: "group"}
+
+	for _, c := range []*tgbotapi.Chat{chat, deleted} {
+		env.fake.Post(c, testUser, "/start")
+		env.expectSent(t)
+		env.fake.Post(c, testUser, "something worth remembering")
+		env.waitFor(t, "message to be remembered", func() bool { return len(env.remembered(c)) == 1 })
+	}
+
+	env.fake.Post(chat, testUser, "/recall")
+	env.expectSent(t)
+	env.expectSent(t)
+	env.fake.Post(empty, testUser, "/recall")
+	env.waitFor(t, "empty recall to fail", func() bool { return env.b.metrics.failed.Get(recallNoMessages) == 1 })
+
+	// A deleted message can't be forwarded, so it's forgotten and posted again.
+	env.fake.Delete(deleted.ID, env.remembered(deleted)[0])
+	env.fake.Post(deleted, testUser, "/recall")
+	env.waitFor(t, "message to be posted again", func() bool { return env.b.metrics.succeeded.Get("") == 2 })
+
+	rec := httptest.NewRecorder()
+	env.b.metrics.handler(env.store).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE irwys_updates_total counter",
+		`irwys_updates_total{type="message"} 7`,
+		"irwys_messages_remembered_total 2",
+		"irwys_recalls_attempted_total 3",
+		"irwys_recalls_succeeded_total 2",
+		`irwys_recalls_failed_total{reason="no_messages"} 1`,
+		`irwys_telegram_api_errors_total{method="forward"} 1`,
+		"# TYPE irwys_chat_messages gauge",
+		`irwys_chat_messages{chat_id="1017"} 1`,
+		"irwys_storage_chats 2",
+		"irwys_storage_messages 1",
+		"# TYPE irwys_storage_messages_size_bytes gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics don't contain %q:\n%s", line, body)
+		}
+	}
+}
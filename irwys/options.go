@@ -1,33 +1,130 @@
 package irwys
 
+import (
+	"fmt"
+	"net/url"
+)
+
 // Options structure.
+// Holds the defaults of chat settings along with bot-wide configuration; zero values of
+// the optional fields leave the corresponding feature off.
 type Options struct {
-	minWords  uint16
-	maxWords  uint16
-	timeout   int16
-	timeStart uint8
-	timeEnd   uint8
-	capacity  uint16
-	dbPath    string
-	replyPath string
-	verbose   bool
+	MinWords  uint16
+	MaxWords  uint16
+	Timeout   int16
+	TimeStart uint8
+	TimeEnd   uint8
+	Capacity  uint16
+	// Probability of recall in percent.
+	Probability uint8
+	// MinInterval between recalls in minutes.
+	MinInterval uint16
+	// MaxPerDay recalls, 0 means unlimited.
+	MaxPerDay uint16
+	// Jitter of recall time in minutes.
+	Jitter uint16
+	// Strategy selecting a message to recall.
+	Strategy string
+	// NoRepeat excludes this many last recalled messages from selection.
+	NoRepeat uint16
+
+	// Storage backend and its location.
+	Storage string
+	DBPath  string
+	// ReplyPath is the directory of reply dictionaries.
+	ReplyPath string
+
+	// Webhook is the public URL Telegram sends updates to, long polling is used if empty.
+	Webhook string
+	Listen  string
+	// Secret expected in the webhook secret token header.
+	Secret  string
+	TLSCert string
+	TLSKey  string
+
+	// AdminListen is the address of the admin HTTP server, it's off if empty.
+	AdminListen string
+	// Health enables health endpoints on the admin server.
+	Health bool
+
+	// Language of new chats.
+	Language string
+}
+
+// Validate checks options make sense together, reporting the first problem found.
+func (o *Options) Validate() error {
+	s := o.defaults()
+	for _, def := range settingDefs {
+		if v := *def.field(&s); v < def.min || v > def.max {
+			return fmt.Errorf("%s (%d) must be between %d and %d", def.name, v, def.min, def.max)
+		}
+	}
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.TimeStart == s.TimeEnd {
+		return fmt.Errorf(
+			"timeStart and timeEnd are both %d, so the bot would never recall "+
+				"(timeStart may be greater than timeEnd to wrap past midnight)", s.TimeStart)
+	}
+	if _, ok := selectors[o.Strategy]; !ok {
+		return fmt.Errorf("unknown strategy %q", o.Strategy)
+	}
+
+	known := false
+	for _, name := range StorageNames {
+		known = known || name == o.Storage
+	}
+	if !known {
+		return fmt.Errorf("unknown storage %q", o.Storage)
+	}
+
+	if o.Webhook != "" {
+		u, err := url.Parse(o.Webhook)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("webhook %q must be an absolute HTTP(S) URL", o.Webhook)
+		}
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return fmt.Errorf("tlsCert and tlsKey must be given together")
+	}
+	if o.Language == "" {
+		return fmt.Errorf("default language can't be empty")
+	}
+	if o.Health && o.AdminListen == "" {
+		return fmt.Errorf("health endpoints need adminListen")
+	}
+	if o.Webhook != "" && o.AdminListen == o.Listen {
+		return fmt.Errorf("adminListen and listen can't both be %s", o.Listen)
+	}
+	return nil
 }
 
-// NewOptions creates an object of NewOptions structure.
-func NewOptions(
-	minWords uint16,
-	maxWords uint16,
-	timeout int16,
-	timeStart uint8,
-	timeEnd uint8,
-	capacity uint16,
-	dbPath string,
-	replyPath string,
-	verbose bool,
-) Options {
-	o := Options{
-		minWords, maxWords, timeout, timeStart, timeEnd,
-		capacity, dbPath, replyPath, verbose,
-	}
-	return o
+// reloaded returns next with options that can't change while the bot runs kept as in o,
+// along with names of the ones next tried to change.
+func (o *Options) reloaded(next Options) (Options, []string) {
+	var ignored []string
+	for _, f := range []struct {
+		name    string
+		changed bool
+	}{
+		{"storage", next.Storage != o.Storage},
+		{"dbPath", next.DBPath != o.DBPath},
+		{"webhook", next.Webhook != o.Webhook},
+		{"listen", next.Listen != o.Listen},
+		{"webhookSecret", next.Secret != o.Secret},
+		{"tlsCert", next.TLSCert != o.TLSCert},
+		{"tlsKey", next.TLSKey != o.TLSKey},
+		{"adminListen", next.AdminListen != o.AdminListen},
+		{"health", next.Health != o.Health},
+	} {
+		if f.changed {
+			ignored = append(ignored, f.name)
+		}
+	}
+
+	next.Storage, next.DBPath = o.Storage, o.DBPath
+	next.Webhook, next.Listen, next.Secret, next.TLSCert, next.TLSKey = o.Webhook, o.Listen, o.Secret, o.TLSCert, o.TLSKey
+	next.AdminListen, next.Health = o.AdminListen, o.Health
+	return next, ignored
 }
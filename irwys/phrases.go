@@ -0,0 +1,353 @@
+package irwys
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// replyContext structure.
+// Describes the recalled message to reply phrases, which are text/template templates.
+type replyContext struct {
+	// Author is the name of the author, or @username if the name is unknown.
+	Author   string
+	Username string
+	// Date is when the message was posted, in the time zone of the chat.
+	Date time.Time
+	// Days and Years count whole days and calendar years passed since the message was posted.
+	Days  int
+	Years int
+	// DateKnown is false for messages of unknown date, like ones migrated from the legacy format.
+	// Date, Days and Years are zero then, and phrases referring to them aren't used.
+	DateKnown bool
+	// Type is the kind of the message: text, photo, video and so on.
+	Type string
+	Chat string
+	// Recalled counts recalls of the message before this one.
+	Recalled int
+
+	// present tells if the author is still in the chat, and if that is known at all.
+	present func() (present bool, known bool)
+}
+
+// newReplyContext describes the message recalled at now to reply phrases.
+func newReplyContext(ref MessageRef, chat string, now time.Time) replyContext {
+	c := replyContext{
+		Author:   ref.AuthorName,
+		Username: ref.Author,
+		Type:     ref.Type,
+		Chat:     chat,
+		Recalled: ref.Recalled,
+	}
+	if ref.Date != 0 {
+		c.Date = ref.Time().In(now.Location())
+		c.Days = int(now.Sub(c.Date).Hours() / 24)
+		c.Years = yearsAgo(ref, now)
+		c.DateKnown = true
+	}
+	if c.Author == "" && c.Username != "" {
+		c.Author = "@" + c.Username
+	}
+	return c
+}
+
+// authorPresent tells if the author is still in the chat, and if that is known at all.
+func (c replyContext) authorPresent() (present bool, known bool) {
+	if c.present == nil {
+		return false, false
+	}
+	return c.present()
+}
+
+// memberPresence returns a function telling if the user is still a member of the chat.
+// Telegram is asked once, on the first call.
+func memberPresence(botAPI Messenger, chatID int64, userID int) func() (bool, bool) {
+	var asked, present, known bool
+	return func() (bool, bool) {
+		if asked || userID == 0 {
+			return present, known
+		}
+		asked = true
+		member, err := botAPI.ChatMember(chatID, userID)
+		if err != nil {
+			Log.Warn("Can't check if the author is in the chat", "chat_id", chatID, "user_id", userID, "error", err)
+			return present, known
+		}
+		present, known = !member.HasLeft() && !member.WasKicked(), true
+		return present, known
+	}
+}
+
+// sampleReplyContext is what phrases are rendered with to be validated.
+var sampleReplyContext = replyContext{
+	Author:   "Test User",
+	Username: "tester",
+	Date:     time.Date(2019, time.May, 1, 12, 0, 0, 0, time.UTC),
+	Days:     400,
+	Years:    1,
+	Type:     messageText,
+
+	DateKnown: true,
+	Chat:      "Test Chat",
+	Recalled:  2,
+}
+
+// conditions structure.
+// Restricts the messages a phrase fits. Conditions left unset always hold.
+type conditions struct {
+	// MinDays and MaxDays bound the age of the message in whole days, inclusive.
+	MinDays *int `yaml:"min_days"`
+	MaxDays *int `yaml:"max_days"`
+	// Hours is the [from, to) range of hours the message was posted within, in the time zone of the chat.
+	// The range wraps around midnight if from is after to.
+	Hours []int `yaml:"hours"`
+	// Types lists kinds of messages the phrase fits.
+	Types []string `yaml:"types"`
+	// AuthorPresent requires the author to still be, or to be no more, a member of the chat.
+	AuthorPresent *bool `yaml:"author_present"`
+}
+
+func (w *conditions) validate() error {
+	if (w.MinDays != nil && *w.MinDays < 0) || (w.MaxDays != nil && *w.MaxDays < 0) {
+		return fmt.Errorf("days can't be negative")
+	}
+	if w.MinDays != nil && w.MaxDays != nil && *w.MinDays > *w.MaxDays {
+		return fmt.Errorf("min_days %d is greater than max_days %d", *w.MinDays, *w.MaxDays)
+	}
+	if w.Hours != nil {
+		if len(w.Hours) != 2 || w.Hours[0] == w.Hours[1] {
+			return fmt.Errorf("hours must be a pair of different hours, from and to")
+		}
+		for _, h := range w.Hours {
+			if h < 0 || h > 24 {
+				return fmt.Errorf("hour %d is out of the day", h)
+			}
+		}
+	}
+	for _, t := range w.Types {
+		if !isMessageType(t) {
+			return fmt.Errorf("unknown message type %q", t)
+		}
+	}
+	return nil
+}
+
+// holds checks if the conditions hold for the message described by c.
+// Conditions on the date never hold for messages of unknown date.
+// Presence of the author is checked last, as it may take a request to Telegram.
+func (w *conditions) holds(c replyContext) bool {
+	if !c.DateKnown && (w.MinDays != nil || w.MaxDays != nil || w.Hours != nil) {
+		return false
+	}
+	if w.MinDays != nil && c.Days < *w.MinDays {
+		return false
+	}
+	if w.MaxDays != nil && c.Days > *w.MaxDays {
+		return false
+	}
+	if w.Hours != nil {
+		from, to, h := w.Hours[0], w.Hours[1], c.Date.Hour()
+		if from < to && (h < from || h >= to) || from > to && h >= to && h < from {
+			return false
+		}
+	}
+	if w.Types != nil && !containsString(w.Types, c.Type) {
+		return false
+	}
+	if w.AuthorPresent != nil {
+		present, known := c.authorPresent()
+		if !known || present != *w.AuthorPresent {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// phrase structure.
+// Keeps a reply phrase along with its parsed template, its weight and conditions of the messages it fits.
+type phrase struct {
+	Text string
+	// Weight is 1 unless set.
+	Weight float64
+	When   *conditions
+	tmpl   *template.Template
+	// dated is set if the phrase refers to the date of the message.
+	dated bool
+}
+
+// newPhrase creates an object of phrase structure without conditions.
+func newPhrase(text string) (phrase, error) {
+	p := phrase{Text: text}
+	if err := p.parse(); err != nil {
+		return phrase{}, err
+	}
+	return p, nil
+}
+
+// parse validates the weight and conditions of the phrase,
+// parses its template and checks it renders.
+func (p *phrase) parse() error {
+	if strings.Contains(p.Text, "%d") {
+		return fmt.Errorf("%%d is not substituted anymore, use {{.Years}}")
+	}
+	if p.Weight == 0 {
+		p.Weight = 1
+	}
+	if p.Weight < 0 {
+		return fmt.Errorf("weight %v is negative", p.Weight)
+	}
+	if p.When != nil {
+		if err := p.When.validate(); err != nil {
+			return err
+		}
+	}
+
+	tmpl, err := template.New("").Parse(p.Text)
+	if err != nil {
+		return err
+	}
+	p.tmpl = tmpl
+	p.dated = refersTo(tmpl.Tree.Root, datedFields)
+	_, err = p.render(sampleReplyContext)
+	return err
+}
+
+// datedFields are fields of replyContext that are zero if the date of the message is unknown.
+var datedFields = []string{"Date", "Days", "Years"}
+
+// refersTo checks if the template node refers to any of fields of its data.
+func refersTo(node parse.Node, fields []string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if refersTo(child, fields) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return refersTo(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if refersTo(cmd, fields) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if refersTo(arg, fields) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return refersTo(&n.BranchNode, fields)
+	case *parse.RangeNode:
+		return refersTo(&n.BranchNode, fields)
+	case *parse.WithNode:
+		return refersTo(&n.BranchNode, fields)
+	case *parse.BranchNode:
+		return refersTo(n.Pipe, fields) || refersTo(n.List, fields) || refersTo(n.ElseList, fields)
+	case *parse.ChainNode:
+		return refersTo(n.Node, fields)
+	case *parse.FieldNode:
+		return containsString(fields, n.Ident[0])
+	case *parse.VariableNode:
+		// $.Date refers to the field of the data.
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && containsString(fields, n.Ident[1])
+	}
+	return false
+}
+
+// UnmarshalYAML parses a phrase from either a YAML string,
+// or a mapping with text and optional weight and conditions under when.
+func (p *phrase) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err == nil {
+		p.Text = text
+		return nil
+	}
+
+	entry := struct {
+		Text   string      `yaml:"text"`
+		Weight float64     `yaml:"weight"`
+		When   *conditions `yaml:"when"`
+	}{}
+	if err := unmarshal(&entry); err != nil {
+		return err
+	}
+	p.Text, p.Weight, p.When = entry.Text, entry.Weight, entry.When
+	return nil
+}
+
+// render executes the template of the phrase with the context.
+func (p phrase) render(c replyContext) (string, error) {
+	buf := new(strings.Builder)
+	if err := p.tmpl.Execute(buf, c); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// hasUnconditional checks if one of phrases fits any message, even one of unknown date.
+func hasUnconditional(pool []phrase) bool {
+	for _, p := range pool {
+		if p.When == nil && !p.dated {
+			return true
+		}
+	}
+	return false
+}
+
+// pickPhrase picks a phrase of the pool fitting the message described by c,
+// at random in proportion to weights. Phrases whose conditions hold are preferred;
+// phrases without conditions are picked only if none of them does.
+// Phrases referring to the date don't fit messages of unknown date.
+// Returns false if no phrase fits the message.
+func pickPhrase(pool []phrase, c replyContext, random *rand.Rand) (phrase, bool) {
+	var fitting, unconditional []phrase
+	for _, p := range pool {
+		switch {
+		case p.dated && !c.DateKnown:
+		case p.When == nil:
+			unconditional = append(unconditional, p)
+		case p.When.holds(c):
+			fitting = append(fitting, p)
+		}
+	}
+	if len(fitting) == 0 {
+		fitting = unconditional
+	}
+	if len(fitting) == 0 {
+		return phrase{}, false
+	}
+
+	total := 0.0
+	for _, p := range fitting {
+		total += p.Weight
+	}
+	x := random.Float64() * total
+	for _, p := range fitting {
+		if x < p.Weight {
+			return p, true
+		}
+		x -= p.Weight
+	}
+	return fitting[len(fitting)-1], true
+}
@@ -0,0 +1,221 @@
+package irwys
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func TestPhraseRender(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	now := time.Date(2021, time.May, 2, 1, 0, 0, 0, loc)
+	ref := MessageRef{
+		ID:       2,
+		Author:   "tester",
+		Date:     time.Date(2019, time.May, 1, 22, 30, 0, 0, time.UTC).Unix(),
+		Type:     messagePhoto,
+		Recalled: 3,
+	}
+
+	for text, want := range map[string]string{
+		"{{.Author}} posted a {{.Type}} in {{.Chat}}":   "@tester posted a photo in Friends",
+		"{{.Days}} days, {{.Years}} years":              "730 days, 2 years",
+		"On {{.Date.Format \"2006-01-02 15:04\"}}":      "On 2019-05-02 01:30",
+		"Recalled {{.Recalled}} times by {{.Username}}": "Recalled 3 times by tester",
+	} {
+		p, err := newPhrase(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.render(newReplyContext(ref, "Friends", now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Rendered %q as %q, want %q", text, got, want)
+		}
+	}
+
+	ref.AuthorName = "Test User"
+	if got := newReplyContext(ref, "", now).Author; got != "Test User" {
+		t.Errorf("Author is %q, want the name over the username", got)
+	}
+}
+
+func intp(i int) *int { return &i }
+
+func boolp(b bool) *bool { return &b }
+
+func TestConditionsHold(t *testing.T) {
+	present := func(present bool, known bool) func() (bool, bool) {
+		return func() (bool, bool) { return present, known }
+	}
+	night := replyContext{Date: time.Date(2019, time.May, 1, 2, 0, 0, 0, time.UTC), Days: 10, Type: messagePhoto, DateKnown: true}
+	noon := replyContext{Date: time.Date(2019, time.May, 1, 12, 0, 0, 0, time.UTC), Days: 10, Type: messageText, DateKnown: true}
+	// A message of unknown date has zero Date and Days.
+	undated := replyContext{Type: messageText}
+
+	for _, c := range []struct {
+		name string
+		when conditions
+		c    replyContext
+		want bool
+	}{
+		{"no conditions", conditions{}, night, true},
+		{"old enough", conditions{MinDays: intp(10)}, night, true},
+		{"too fresh", conditions{MinDays: intp(11)}, night, false},
+		{"too old", conditions{MaxDays: intp(9)}, night, false},
+		{"within hours", conditions{Hours: []int{0, 5}}, night, true},
+		{"out of hours", conditions{Hours: []int{0, 5}}, noon, false},
+		{"hours around midnight", conditions{Hours: []int{22, 3}}, night, true},
+		{"out of hours around midnight", conditions{Hours: []int{22, 3}}, noon, false},
+		{"type", conditions{Types: []string{messagePhoto, messageVideo}}, night, true},
+		{"other type", conditions{Types: []string{messagePhoto}}, noon, false},
+		{"author present", conditions{AuthorPresent: boolp(true)}, replyContext{present: present(true, true)}, true},
+		{"author left", conditions{AuthorPresent: boolp(false)}, replyContext{present: present(false, true)}, true},
+		{"author not left", conditions{AuthorPresent: boolp(false)}, replyContext{present: present(true, true)}, false},
+		{"presence unknown", conditions{AuthorPresent: boolp(false)}, replyContext{present: present(false, false)}, false},
+		{"presence not checked", conditions{AuthorPresent: boolp(false)}, replyContext{}, false},
+		{"min days of unknown date", conditions{MinDays: intp(0)}, undated, false},
+		{"max days of unknown date", conditions{MaxDays: intp(7)}, undated, false},
+		{"hours of unknown date", conditions{Hours: []int{0, 5}}, undated, false},
+		{"type of unknown date", conditions{Types: []string{messageText}}, undated, true},
+	} {
+		if got := c.when.holds(c.c); got != c.want {
+			t.Errorf("%s: holds = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPickPhrase(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	fresh := &conditions{MaxDays: intp(7)}
+	text := &conditions{Types: []string{messageText}}
+	pool := []phrase{
+		{Text: "any", Weight: 100},
+		{Text: "fresh", Weight: 3, When: fresh},
+		{Text: "text", Weight: 1, When: text},
+		{Text: "never", Weight: 100, When: &conditions{Types: []string{messageSticker}}},
+	}
+	known := func(days int, msgType string) replyContext {
+		return replyContext{Days: days, Type: msgType, DateKnown: true}
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		p, ok := pickPhrase(pool, known(1, messageText), random)
+		if !ok {
+			t.Fatal("No phrase picked")
+		}
+		picked[p.Text]++
+	}
+	// Phrases whose conditions hold are preferred to unconditional ones.
+	if picked["never"] != 0 || picked["any"] != 0 {
+		t.Errorf("Picked phrases not fitting best: %v", picked)
+	}
+	// Fitting phrases are picked in proportion to weights, 3:1.
+	if picked["fresh"] < 2700 || picked["fresh"] > 3300 {
+		t.Errorf("Picked the fresh phrase %d times out of 4000, want about 3000", picked["fresh"])
+	}
+
+	// Unconditional phrases are the fallback when no conditions hold.
+	for _, c := range []replyContext{known(100, messagePhoto), {Days: 1, Type: messagePhoto}} {
+		for i := 0; i < 100; i++ {
+			if p, _ := pickPhrase(pool, c, random); p.Text != "any" {
+				t.Fatalf("Picked %q for %+v", p.Text, c)
+			}
+		}
+	}
+
+	if _, ok := pickPhrase(pool[1:], known(100, messagePhoto), random); ok {
+		t.Error("Picked a phrase though none fits")
+	}
+}
+
+// membershipMessenger reports users as having left chats and counts the requests.
+type membershipMessenger struct {
+	*FakeMessenger
+	requests int
+}
+
+func (m *membershipMessenger) ChatMember(chatID int64, userID int) (tgbotapi.ChatMember, error) {
+	m.requests++
+	return tgbotapi.ChatMember{User: &tgbotapi.User{ID: userID}, Status: "left"}, nil
+}
+
+func TestMemberPresence(t *testing.T) {
+	botAPI := &membershipMessenger{FakeMessenger: NewFakeMessenger(tgbotapi.User{ID: 1})}
+
+	present := memberPresence(botAPI, 1, 42)
+	for i := 0; i < 3; i++ {
+		if p, known := present(); p || !known {
+			t.Fatalf("present() = %v, %v, want false, true", p, known)
+		}
+	}
+	if botAPI.requests != 1 {
+		t.Errorf("Asked Telegram %d times, want once", botAPI.requests)
+	}
+
+	// Authors of messages without one, like channel posts, are never asked about.
+	if _, known := memberPresence(botAPI, 1, 0)(); known || botAPI.requests != 1 {
+		t.Error("Asked about presence of an unknown author")
+	}
+}
+
+func TestLegacyReply(t *testing.T) {
+	dicts, err := loadDictionaries("../replies", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages migrated from the legacy format have nothing but the ID.
+	c := newReplyContext(MessageRef{ID: 2}, "", time.Now())
+	if c.DateKnown || c.Days != 0 || c.Years != 0 {
+		t.Fatalf("Got a date for a message of unknown date: %+v", c)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for _, lang := range []string{"en", "ru"} {
+		for _, key := range []string{textReplies, photoReplies} {
+			for i := 0; i < 200; i++ {
+				p, ok := pickPhrase(dicts.Pool(lang, key), c, random)
+				if !ok {
+					t.Fatalf("No %s %s reply for a message of unknown date", lang, key)
+				}
+				if p.dated {
+					t.Fatalf("Picked %q referring to the unknown date", p.Text)
+				}
+				reply, err := p.render(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(reply, "1970") || strings.Contains(reply, " 0 ") {
+					t.Fatalf("Rendered %q for a message of unknown date", reply)
+				}
+			}
+		}
+	}
+}
+
+func TestPhraseDated(t *testing.T) {
+	for text, want := range map[string]bool{
+		"Do you remember this?":                    false,
+		"{{.Author}} said this":                    false,
+		"{{.Days}} days ago":                       true,
+		"Back on {{.Date.Format \"2006\"}}":        true,
+		"{{if gt .Years 1}}long ago{{end}}":        true,
+		"{{with .Author}}{{$.Years}} years{{end}}": true,
+		"{{if .Author}}hi{{else}}{{.Days}}{{end}}": true,
+		"{{$a := .Author}}{{$a}}":                  false,
+	} {
+		p, err := newPhrase(text)
+		if err != nil {
+			t.Fatalf("%s: %s", text, err)
+		}
+		if p.dated != want {
+			t.Errorf("%q dated = %v, want %v", text, p.dated, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package irwys
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RecallStats counts recalls made in a chat.
+type RecallStats struct {
+	// Last is the Unix time of the last recall.
+	Last int64 `json:"last,omitempty"`
+	// Day is the date Count refers to, in the chat's time zone.
+	Day   string `json:"day,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+const statsDayLayout = "2006-01-02"
+
+// today returns how many recalls were made on the day of now.
+func (s RecallStats) today(now time.Time, loc *time.Location) int {
+	if s.Day != now.In(loc).Format(statsDayLayout) {
+		return 0
+	}
+	return s.Count
+}
+
+// add accounts a recall made at now.
+func (s RecallStats) add(now time.Time, loc *time.Location) RecallStats {
+	return RecallStats{
+		Last:  now.Unix(),
+		Day:   now.In(loc).Format(statsDayLayout),
+		Count: s.today(now, loc) + 1,
+	}
+}
+
+// recallPolicy decides when a silent chat gets a recall.
+// It doesn't read the clock or the global random source itself,
+// so decisions are reproducible given the time and a seeded source.
+type recallPolicy struct {
+	settings Settings
+	random   *rand.Rand
+}
+
+// newRecallPolicy creates an object of recallPolicy structure.
+func newRecallPolicy(settings Settings, random *rand.Rand) recallPolicy {
+	return recallPolicy{settings, random}
+}
+
+// jitter returns a random delay of up to Jitter minutes.
+func (p recallPolicy) jitter() time.Duration {
+	if p.settings.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(p.random.Int63n(int64(p.settings.Jitter)*int64(time.Minute) + 1))
+}
+
+// afterMessage returns when the chat is due if it stays silent after a message posted at t.
+func (p recallPolicy) afterMessage(t time.Time) time.Time {
+	return t.Add(time.Duration(p.settings.Timeout)*time.Minute + p.jitter())
+}
+
+// decide tells whether to recall at now and when the chat is due next.
+func (p recallPolicy) decide(now time.Time, stats RecallStats) (recall bool, next time.Time) {
+	s := p.settings
+
+	if !s.active(now) {
+		return false, s.nextActive(now).Add(p.jitter())
+	}
+
+	if s.MaxPerDay > 0 && stats.today(now, s.Location) >= s.MaxPerDay {
+		local := now.In(s.Location)
+		tomorrow := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, s.Location)
+		return false, tomorrow.Add(p.jitter())
+	}
+
+	if s.MinInterval > 0 && stats.Last > 0 {
+		allowed := time.Unix(stats.Last, 0).Add(time.Duration(s.MinInterval) * time.Minute)
+		if now.Before(allowed) {
+			return false, allowed.Add(p.jitter())
+		}
+	}
+
+	recall = p.random.Float64()*100 < float64(s.Probability)
+	return recall, p.afterMessage(now)
+}
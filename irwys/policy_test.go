@@ -0,0 +1,140 @@
+package irwys
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testPolicySettings() Settings {
+	return Settings{
+		Timeout:     30,
+		TimeStart:   9,
+		TimeEnd:     23,
+		Probability: 100,
+		Location:    time.UTC,
+	}
+}
+
+func TestPolicyDecide(t *testing.T) {
+	noon := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		modify func(s *Settings)
+		now    time.Time
+		stats  RecallStats
+		recall bool
+		next   time.Time
+	}{
+		{
+			name:   "recall",
+			now:    noon,
+			recall: true,
+			next:   noon.Add(30 * time.Minute),
+		},
+		{
+			name:   "zero probability",
+			modify: func(s *Settings) { s.Probability = 0 },
+			now:    noon,
+			next:   noon.Add(30 * time.Minute),
+		},
+		{
+			name: "outside of active hours",
+			now:  time.Date(2020, 3, 1, 23, 10, 0, 0, time.UTC),
+			next: time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "too soon after last recall",
+			modify: func(s *Settings) { s.MinInterval = 120 },
+			now:    noon,
+			stats:  RecallStats{Last: noon.Add(-time.Hour).Unix()},
+			next:   noon.Add(time.Hour),
+		},
+		{
+			name:   "interval passed",
+			modify: func(s *Settings) { s.MinInterval = 60 },
+			now:    noon,
+			stats:  RecallStats{Last: noon.Add(-time.Hour).Unix()},
+			recall: true,
+			next:   noon.Add(30 * time.Minute),
+		},
+		{
+			name:   "daily limit reached",
+			modify: func(s *Settings) { s.MaxPerDay = 2 },
+			now:    noon,
+			stats:  RecallStats{Day: "2020-03-01", Count: 2},
+			next:   time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "daily limit of another day",
+			modify: func(s *Settings) { s.MaxPerDay = 2 },
+			now:    noon,
+			stats:  RecallStats{Day: "2020-02-29", Count: 2},
+			recall: true,
+			next:   noon.Add(30 * time.Minute),
+		},
+	}
+
+	for _, c := range cases {
+		s := testPolicySettings()
+		if c.modify != nil {
+			c.modify(&s)
+		}
+		p := newRecallPolicy(s, rand.New(rand.NewSource(1)))
+		recall, next := p.decide(c.now, c.stats)
+		if recall != c.recall || !next.Equal(c.next) {
+			t.Errorf("%s: got recall %t next %s, want recall %t next %s",
+				c.name, recall, next, c.recall, c.next)
+		}
+	}
+}
+
+func TestPolicyProbability(t *testing.T) {
+	s := testPolicySettings()
+	s.Probability = 30
+	p := newRecallPolicy(s, rand.New(rand.NewSource(42)))
+	noon := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	recalls := 0
+	for i := 0; i < 10000; i++ {
+		if recall, _ := p.decide(noon, RecallStats{}); recall {
+			recalls++
+		}
+	}
+	if recalls < 2800 || recalls > 3200 {
+		t.Fatalf("Recalled %d times out of 10000 with 30%% probability", recalls)
+	}
+}
+
+func TestPolicyJitter(t *testing.T) {
+	s := testPolicySettings()
+	s.Jitter = 10
+	posted := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	a := newRecallPolicy(s, rand.New(rand.NewSource(7)))
+	b := newRecallPolicy(s, rand.New(rand.NewSource(7)))
+	for i := 0; i < 100; i++ {
+		due := a.afterMessage(posted)
+		if due.Before(posted.Add(30*time.Minute)) || due.After(posted.Add(40*time.Minute)) {
+			t.Fatalf("Due at %s, out of jitter range", due)
+		}
+		if other := b.afterMessage(posted); !other.Equal(due) {
+			t.Fatalf("Same seed gave %s and %s", due, other)
+		}
+	}
+}
+
+func TestRecallStatsAdd(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	stats := RecallStats{Day: "2020-03-01", Count: 4}
+
+	// 21:30 UTC is already the next day in Moscow.
+	now := time.Date(2020, 3, 1, 21, 30, 0, 0, time.UTC)
+	if got := stats.add(now, moscow); got.Day != "2020-03-02" || got.Count != 1 || got.Last != now.Unix() {
+		t.Fatalf("Got %+v", got)
+	}
+	if got := stats.add(now, time.UTC); got.Day != "2020-03-01" || got.Count != 5 {
+		t.Fatalf("Got %+v", got)
+	}
+}
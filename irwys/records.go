@@ -0,0 +1,466 @@
+package irwys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// schemaVersion is written as the first byte of every record.
+// Records are stored as the version byte followed by a JSON document.
+// Anything else found in the database is treated as a legacy gob value.
+const schemaVersion byte = 1
+
+// ChatConfig holds the configuration of a chat.
+type ChatConfig struct {
+	Language string `json:"language"`
+	// Timezone is an IANA time zone name recall hours are evaluated in.
+	Timezone string `json:"timezone,omitempty"`
+	// Strategy names the selector picking messages to recall.
+	Strategy string `json:"strategy,omitempty"`
+	// Settings override options for the chat, keyed by setting name.
+	Settings map[string]int `json:"settings,omitempty"`
+	// Replies are phrases of the chat by kind of recalled message, text or photo.
+	Replies map[string][]string `json:"replies,omitempty"`
+	// Recalls counts recalls made by the scheduler.
+	Recalls RecallStats `json:"recalls"`
+}
+
+// MessageRef references a remembered message and keeps its content,
+// so it can be posted again if the original is gone.
+// Records migrated from the legacy format carry the ID only.
+type MessageRef struct {
+	ID         int      `json:"id"`
+	AuthorID   int      `json:"author_id,omitempty"`
+	Author     string   `json:"author,omitempty"`
+	AuthorName string   `json:"author_name,omitempty"`
+	Date       int64    `json:"date,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	FileIDs    []string `json:"file_ids,omitempty"`
+	ReplyToID  int      `json:"reply_to_id,omitempty"`
+	// Replies counts messages posted in reply to this one.
+	Replies int `json:"replies,omitempty"`
+	// Recalled counts recalls of the message, RecalledAt is the Unix time of the last one.
+	Recalled   int   `json:"recalled,omitempty"`
+	RecalledAt int64 `json:"recalled_at,omitempty"`
+}
+
+func encodeRecord(value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{schemaVersion}, data...), nil
+}
+
+func decodeRecord(data []byte, value interface{}) error {
+	if !isRecord(data) {
+		return fmt.Errorf("not a versioned record")
+	}
+	if data[0] > schemaVersion {
+		return fmt.Errorf("unsupported schema version %d", data[0])
+	}
+	return json.Unmarshal(data[1:], value)
+}
+
+func isRecord(data []byte) bool {
+	return len(data) > 0 && data[0] != 0 && data[0] <= schemaVersion && json.Valid(data[1:])
+}
+
+func decodeLegacy(data []byte) (decoded interface{}, err error) {
+	gob.Register(map[string]string{})
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded)
+	return
+}
+
+func chatKey(chatID int64) string {
+	return strconv.FormatInt(chatID, 10)
+}
+
+// migrate rewrites every legacy gob value in db as a versioned record,
+// using upgrade to convert the decoded value. Returns the number of upgraded records.
+func migrate(db DB, upgrade func(legacy interface{}) (interface{}, error)) (n int, err error) {
+	it := db.Iterate(nil)
+	for it.Next() {
+		if isRecord(it.Value()) {
+			continue
+		}
+
+		key := string(it.Key())
+		legacy, err := decodeLegacy(it.Value())
+		if err != nil {
+			it.Release()
+			return n, fmt.Errorf("can't decode legacy value of %s: %s", key, err)
+		}
+		value, err := upgrade(legacy)
+		if err != nil {
+			it.Release()
+			return n, fmt.Errorf("can't upgrade legacy value of %s: %s", key, err)
+		}
+		data, err := encodeRecord(value)
+		if err != nil {
+			it.Release()
+			return n, err
+		}
+		db.BatchPut(key, data)
+		n++
+	}
+	it.Release()
+	if err = it.Error(); err != nil {
+		return
+	}
+
+	if n > 0 {
+		err = db.BatchWrite()
+	}
+
+	return
+}
+
+// levelChatStore structure.
+// Implements ChatStore on top of LevelDB, keeping a record per chat.
+type levelChatStore struct {
+	db   DB
+	lock *sync.Mutex
+}
+
+// NewChatStore creates a ChatStore kept in the database.
+func NewChatStore(db DB) ChatStore {
+	lock := sync.Mutex{}
+	return levelChatStore{db, &lock}
+}
+
+// Get returns configuration of the chat and whether it exists.
+func (s levelChatStore) Get(chatID int64) (conf ChatConfig, ok bool, err error) {
+	data, err := s.db.Get(chatKey(chatID))
+	if err != nil || data == nil {
+		return
+	}
+	if err = decodeRecord(data, &conf); err != nil {
+		Log.Error("Can't decode chat config", "chat_id", chatID, "error", err)
+		return
+	}
+
+	return conf, true, nil
+}
+
+// Put saves configuration of the chat.
+func (s levelChatStore) Put(chatID int64, conf ChatConfig) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	return s.put(chatID, conf)
+}
+
+// put saves configuration of the chat, the lock must be held.
+func (s levelChatStore) put(chatID int64, conf ChatConfig) error {
+	data, err := encodeRecord(conf)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(chatKey(chatID), data)
+}
+
+// Update changes configuration of an existing chat with fn.
+// Nothing is saved if the chat doesn't exist or fn fails.
+func (s levelChatStore) Update(chatID int64, fn func(conf *ChatConfig) error) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	conf, ok, err := s.Get(chatID)
+	if err != nil || !ok {
+		return err
+	}
+	if err = fn(&conf); err != nil {
+		return err
+	}
+	return s.put(chatID, conf)
+}
+
+// Delete removes configuration of the chat.
+// It waits for updates in progress, so they can't bring the chat back.
+func (s levelChatStore) Delete(chatID int64) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	return s.db.Delete(chatKey(chatID))
+}
+
+// Exist checks if the chat has configuration.
+func (s levelChatStore) Exist(chatID int64) (bool, error) {
+	return s.db.Exist(chatKey(chatID))
+}
+
+// IDs returns identifiers of all known chats.
+func (s levelChatStore) IDs() ([]int64, error) {
+	return chatIDs(s.db)
+}
+
+// chatIDs returns identifiers of chats db has records of.
+func chatIDs(db DB) (ids []int64, err error) {
+	it := db.Iterate(nil)
+	defer it.Release()
+
+	for it.Next() {
+		id, err := strconv.ParseInt(string(it.Key()), 10, 64)
+		if err != nil {
+			Log.Warn("Skipping malformed chat key", "key", string(it.Key()))
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, it.Error()
+}
+
+// Migrate upgrades chat configs written in the legacy gob format.
+func (s levelChatStore) Migrate() (int, error) {
+	return migrate(s.db, func(legacy interface{}) (interface{}, error) {
+		m, ok := legacy.(map[string]string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T", legacy)
+		}
+		return ChatConfig{Language: m["language"]}, nil
+	})
+}
+
+// Close the underlying database.
+func (s levelChatStore) Close() {
+	s.db.Close()
+}
+
+// levelMessageStore structure.
+// Implements MessageStore on top of LevelDB, keeping a record with all messages per chat.
+type levelMessageStore struct {
+	db     DB
+	lock   *sync.Mutex
+	counts *messageCounts
+}
+
+// NewMessageStore creates a MessageStore kept in the database.
+func NewMessageStore(db DB) MessageStore {
+	lock := sync.Mutex{}
+	return levelMessageStore{db, &lock, newMessageCounts()}
+}
+
+// messageCounts structure.
+// Keeps numbers of remembered messages per chat, which are read from the database once
+// and then kept up to date by writes, so they can be scraped often.
+type messageCounts struct {
+	counts map[int64]int
+	lock   *sync.Mutex
+}
+
+// newMessageCounts creates an object of messageCounts structure.
+func newMessageCounts() *messageCounts {
+	lock := sync.Mutex{}
+	c := messageCounts{nil, &lock}
+	return &c
+}
+
+// set changes the number of messages of the chat, if numbers are read already.
+func (c *messageCounts) set(chatID int64, n int) {
+	(*c.lock).Lock()
+	defer (*c.lock).Unlock()
+
+	if c.counts == nil {
+		return
+	}
+	if n == 0 {
+		delete(c.counts, chatID)
+	} else {
+		c.counts[chatID] = n
+	}
+}
+
+// reset makes numbers be read from the database again.
+func (c *messageCounts) reset() {
+	(*c.lock).Lock()
+	c.counts = nil
+	(*c.lock).Unlock()
+}
+
+// get returns a copy of numbers of messages per chat, reading them with load the first time.
+func (c *messageCounts) get(load func() (map[int64]int, error)) (map[int64]int, error) {
+	(*c.lock).Lock()
+	defer (*c.lock).Unlock()
+
+	if c.counts == nil {
+		counts, err := load()
+		if err != nil {
+			return nil, err
+		}
+		c.counts = counts
+	}
+	counts := make(map[int64]int, len(c.counts))
+	for id, n := range c.counts {
+		counts[id] = n
+	}
+	return counts, nil
+}
+
+// Get returns remembered messages of the chat, oldest first.
+func (s levelMessageStore) Get(chatID int64) (refs []MessageRef, err error) {
+	data, err := s.db.Get(chatKey(chatID))
+	if err != nil || data == nil {
+		return
+	}
+	if err = decodeRecord(data, &refs); err != nil {
+		Log.Error("Can't decode messages", "chat_id", chatID, "error", err)
+	}
+
+	return
+}
+
+// Put saves remembered messages of the chat.
+func (s levelMessageStore) Put(chatID int64, refs []MessageRef) error {
+	data, err := encodeRecord(refs)
+	if err != nil {
+		return err
+	}
+	if err = s.db.Put(chatKey(chatID), data); err != nil {
+		return err
+	}
+	s.counts.set(chatID, len(refs))
+	return nil
+}
+
+// Append remembers a message of the chat,
+// dropping the oldest ones to keep no more than capacity messages.
+func (s levelMessageStore) Append(chatID int64, ref MessageRef, capacity int) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	refs, err := s.Get(chatID)
+	if err != nil {
+		return err
+	}
+	if len(refs) >= capacity {
+		refs = refs[len(refs)-capacity+1:]
+	}
+	return s.Put(chatID, append(refs, ref))
+}
+
+// Remove forgets a message of the chat.
+func (s levelMessageStore) Remove(chatID int64, messageID int) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	refs, err := s.Get(chatID)
+	if err != nil {
+		return err
+	}
+	kept := refs[:0]
+	for _, ref := range refs {
+		if ref.ID != messageID {
+			kept = append(kept, ref)
+		}
+	}
+	if len(kept) == len(refs) {
+		return nil
+	}
+	return s.Put(chatID, kept)
+}
+
+// CountReply accounts a reply to a remembered message of the chat.
+func (s levelMessageStore) CountReply(chatID int64, messageID int) error {
+	return s.update(chatID, messageID, func(ref *MessageRef) {
+		ref.Replies++
+	})
+}
+
+// MarkRecalled accounts a recall of a remembered message of the chat.
+func (s levelMessageStore) MarkRecalled(chatID int64, messageID int, at time.Time) error {
+	return s.update(chatID, messageID, func(ref *MessageRef) {
+		ref.Recalled++
+		ref.RecalledAt = at.Unix()
+	})
+}
+
+// update changes a remembered message with fn, if the chat still remembers it.
+func (s levelMessageStore) update(chatID int64, messageID int, fn func(ref *MessageRef)) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	refs, err := s.Get(chatID)
+	if err != nil {
+		return err
+	}
+	for i := range refs {
+		if refs[i].ID == messageID {
+			fn(&refs[i])
+			return s.Put(chatID, refs)
+		}
+	}
+	return nil
+}
+
+// Query returns remembered messages of the chat matching q, oldest first.
+func (s levelMessageStore) Query(chatID int64, q MessageQuery) ([]MessageRef, error) {
+	refs, err := s.Get(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return q.filter(refs), nil
+}
+
+// IDs returns identifiers of chats with remembered messages.
+func (s levelMessageStore) IDs() ([]int64, error) {
+	return chatIDs(s.db)
+}
+
+// Counts returns numbers of remembered messages per chat.
+func (s levelMessageStore) Counts() (map[int64]int, error) {
+	return s.counts.get(func() (map[int64]int, error) {
+		ids, err := s.IDs()
+		if err != nil {
+			return nil, err
+		}
+		counts := map[int64]int{}
+		for _, id := range ids {
+			refs, err := s.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			if len(refs) > 0 {
+				counts[id] = len(refs)
+			}
+		}
+		return counts, nil
+	})
+}
+
+// Delete forgets all messages of the chat.
+func (s levelMessageStore) Delete(chatID int64) error {
+	if err := s.db.Delete(chatKey(chatID)); err != nil {
+		return err
+	}
+	s.counts.set(chatID, 0)
+	return nil
+}
+
+// Migrate upgrades message lists written in the legacy gob format.
+func (s levelMessageStore) Migrate() (int, error) {
+	defer s.counts.reset()
+	return migrate(s.db, func(legacy interface{}) (interface{}, error) {
+		ids, ok := legacy.([]int)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T", legacy)
+		}
+		refs := make([]MessageRef, len(ids))
+		for i, id := range ids {
+			refs[i] = MessageRef{ID: id}
+		}
+		return refs, nil
+	})
+}
+
+// Close the underlying database.
+func (s levelMessageStore) Close() {
+	s.db.Close()
+}
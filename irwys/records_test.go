@@ -0,0 +1,58 @@
+package irwys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func putLegacy(t *testing.T, db DB, key string, value interface{}) {
+	t.Helper()
+	gob.Register(map[string]string{})
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(&value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(key, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	store := NewLevelStore(dir, &opt.Options{}).(levelStore)
+	defer store.Close()
+	dbMessages := store.Messages()
+	dbChats := store.Chats()
+
+	putLegacy(t, store.messages.db, "-100", []int{3, 5, 8})
+	putLegacy(t, store.chats.db, "-100", map[string]string{"language": "ru"})
+	if err := dbChats.Put(-200, ChatConfig{Language: "en"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := dbMessages.Migrate(); err != nil || n != 1 {
+		t.Fatalf("Migrated %d messages records (%v), want 1", n, err)
+	}
+	if n, err := dbChats.Migrate(); err != nil || n != 1 {
+		t.Fatalf("Migrated %d chats records (%v), want 1", n, err)
+	}
+
+	refs, err := dbMessages.Get(-100)
+	if err != nil || !reflect.DeepEqual(refs, []MessageRef{{ID: 3}, {ID: 5}, {ID: 8}}) {
+		t.Fatalf("Got messages %v (%v)", refs, err)
+	}
+	for id, lang := range map[int64]string{-100: "ru", -200: "en"} {
+		if conf, ok, err := dbChats.Get(id); !ok || err != nil || conf.Language != lang {
+			t.Fatalf("Got chat %d config %+v (%v), want language %s", id, conf, err, lang)
+		}
+	}
+
+	if n, err := dbChats.Migrate(); err != nil || n != 0 {
+		t.Fatalf("Second migration upgraded %d records (%v), want 0", n, err)
+	}
+}
@@ -0,0 +1,114 @@
+package irwys
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+)
+
+// Results of reloads counted by metrics.
+const (
+	reloadOK     = "ok"
+	reloadFailed = "failed"
+)
+
+// config structure.
+// Options and reply dictionaries the bot works with, which are swapped together on reload.
+type config struct {
+	opts  *Options
+	dicts *dictionaries
+}
+
+// configBook structure.
+// Holds the config in use and the function reading options again on reload.
+type configBook struct {
+	current config
+	load    func() (Options, error)
+	lock    *sync.RWMutex
+}
+
+// newConfigBook creates an object of configBook structure.
+func newConfigBook(opts *Options) *configBook {
+	lock := sync.RWMutex{}
+	c := configBook{config{opts, &dictionaries{}}, nil, &lock}
+	return &c
+}
+
+func (c *configBook) get() config {
+	(*c.lock).RLock()
+	defer (*c.lock).RUnlock()
+
+	return c.current
+}
+
+func (c *configBook) set(conf config) {
+	(*c.lock).Lock()
+	c.current = conf
+	(*c.lock).Unlock()
+}
+
+func (c *configBook) loader() func() (Options, error) {
+	(*c.lock).RLock()
+	defer (*c.lock).RUnlock()
+
+	return c.load
+}
+
+// ReloadOptions makes the bot read its options with load when it's reloaded.
+// Without it, only reply dictionaries are reloaded.
+func (b bot) ReloadOptions(load func() (Options, error)) {
+	(*b.config.lock).Lock()
+	b.config.load = load
+	(*b.config.lock).Unlock()
+}
+
+// reload reads options and reply dictionaries again and swaps them for the ones in use at once,
+// unless any of them is invalid, in which case the ones in use are kept.
+// Options the bot can't change while running keep their values.
+func (b bot) reload() error {
+	opts := *b.opts()
+	if load := b.config.loader(); load != nil {
+		next, err := load()
+		if err != nil {
+			return err
+		}
+		if err = next.Validate(); err != nil {
+			return err
+		}
+		var ignored []string
+		if opts, ignored = opts.reloaded(next); len(ignored) > 0 {
+			Log.Warn("Options can't change until restart", "options", strings.Join(ignored, ","))
+		}
+	}
+
+	dicts, err := loadDictionaries(opts.ReplyPath, opts.Language)
+	if err != nil {
+		return err
+	}
+	b.config.set(config{&opts, dicts})
+	Log.Info("Reloaded", "path", opts.ReplyPath, "languages", strings.Join(dicts.Languages(), ","))
+	return nil
+}
+
+// reloadOn reloads the bot every time it gets one of signals, until ctx is done.
+func (b bot) reloadOn(ctx context.Context, signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if err := b.reload(); err != nil {
+				Log.Error("Can't reload, keeping the current configuration", "error", err)
+				b.metrics.reloads.Inc(reloadFailed)
+				continue
+			}
+			b.metrics.reloads.Inc(reloadOK)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package irwys
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	dir := writeReplies(t, map[string]string{
+		"en.yml": "text: [hello]\nphoto: [nice]\n",
+		"ru.yml": "text: [привет]\nphoto: [красиво]\n",
+	})
+	opts := Options{
+		MinWords: 2, MaxWords: 100, Timeout: 600, TimeStart: 9, TimeEnd: 23, Capacity: 16, Probability: 30,
+		Strategy: "uniform", Storage: MemoryStorage, ReplyPath: dir, Language: "en",
+	}
+	b := New("", &opts)
+	if err := b.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(b.dicts().Pool("en", textReplies)); got[0] != "hello" {
+		t.Fatalf("Got replies %v, want [hello]", got)
+	}
+
+	rewrite := func(content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "en.yml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A broken dictionary leaves the ones in use live.
+	rewrite("text: ['{{.Nope}}']\nphoto: [nice]\n")
+	if err := b.reload(); err == nil {
+		t.Fatal("Reloaded a broken dictionary")
+	}
+	if got := texts(b.dicts().Pool("en", textReplies)); got[0] != "hello" {
+		t.Fatalf("Got replies %v after a failed reload, want [hello]", got)
+	}
+	rewrite("text: [hi]\nphoto: [nice]\n")
+
+	next := opts
+	next.MinWords, next.Strategy, next.Language = 3, "older", "ru"
+	next.Storage, next.DBPath = SQLiteStorage, "db"
+	var loadErr error
+	b.ReloadOptions(func() (Options, error) { return next, loadErr })
+
+	loadErr = fmt.Errorf("config is gone")
+	if err := b.reload(); err != loadErr {
+		t.Fatalf("Got error %v, want %v", err, loadErr)
+	}
+	loadErr = nil
+	next.TimeStart = next.TimeEnd
+	if err := b.reload(); err == nil {
+		t.Fatal("Reloaded invalid options")
+	}
+	if b.opts().Strategy != "uniform" || b.opts().MinWords != 2 {
+		t.Fatalf("Options changed by failed reloads: %+v", *b.opts())
+	}
+
+	next.TimeStart = 9
+	if err := b.reload(); err != nil {
+		t.Fatal(err)
+	}
+	got := b.opts()
+	if got.Strategy != "older" || got.MinWords != 3 || got.Language != "ru" {
+		t.Fatalf("Options weren't reloaded: %+v", *got)
+	}
+	// The storage can't be changed while running.
+	if got.Storage != MemoryStorage || got.DBPath != "" {
+		t.Fatalf("Storage changed to %s at %q", got.Storage, got.DBPath)
+	}
+	if pool := texts(b.dicts().Pool("fr", textReplies)); pool[0] != "привет" {
+		t.Fatalf("Got replies %v, want ones of the new default language", pool)
+	}
+}
+
+func TestReloadSwapsConfigAtOnce(t *testing.T) {
+	opts := Options{
+		MinWords: 2, MaxWords: 100, Timeout: 600, TimeStart: 9, TimeEnd: 23, Capacity: 16, Probability: 30,
+		Strategy: "uniform", Storage: MemoryStorage, ReplyPath: "../replies", Language: "en",
+	}
+	b := New("", &opts)
+	language := "en"
+	b.ReloadOptions(func() (Options, error) {
+		next := opts
+		next.Language = language
+		return next, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			language = []string{"en", "ru"}[i%2]
+			if err := b.reload(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if conf := b.config.get(); conf.dicts.fallback != "" && conf.dicts.fallback != conf.opts.Language {
+			t.Errorf("Options of %s are used with dictionaries falling back to %s", conf.opts.Language, conf.dicts.fallback)
+			<-done
+			return
+		}
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	// Keeps the process alive if SIGHUP arrives before the bot listens to it.
+	hold := make(chan os.Signal, 1)
+	signal.Notify(hold, syscall.SIGHUP)
+	defer signal.Stop(hold)
+
+	opts := Options{
+		MinWords: 2, MaxWords: 100, Timeout: 600, TimeStart: 9, TimeEnd: 23, Capacity: 16, Probability: 30,
+		Strategy: "uniform", Storage: MemoryStorage, ReplyPath: "../replies", Language: "en",
+	}
+	b := New("", &opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.reloadOn(ctx, syscall.SIGHUP)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.metrics.reloads.Get(reloadOK) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a reload")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !b.dicts().Has("ru") {
+		t.Fatal("Replies weren't loaded on reload")
+	}
+}
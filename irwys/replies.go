@@ -0,0 +1,136 @@
+package irwys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Keys of reply pools in dictionaries.
+const (
+	textReplies        = "text"
+	photoReplies       = "photo"
+	anniversaryReplies = "anniversary"
+)
+
+// dictionary structure.
+// Keeps phrases the bot replies with in a language, a pool per kind of recalled message.
+type dictionary struct {
+	Text  []phrase `yaml:"text"`
+	Photo []phrase `yaml:"photo"`
+	// Anniversary phrases are used for messages posted on this day years ago, they are optional.
+	Anniversary []phrase `yaml:"anniversary"`
+}
+
+// pool returns phrases kept under the key.
+func (d *dictionary) pool(key string) []phrase {
+	switch key {
+	case textReplies:
+		return d.Text
+	case photoReplies:
+		return d.Photo
+	case anniversaryReplies:
+		return d.Anniversary
+	}
+	return nil
+}
+
+// validate checks every pool is either optional or has phrases to fall back to
+// whatever the message is, and parses phrases.
+func (d *dictionary) validate() error {
+	for _, key := range []string{textReplies, photoReplies, anniversaryReplies} {
+		pool := d.pool(key)
+		if len(pool) == 0 && key != anniversaryReplies {
+			return fmt.Errorf("%s replies are missing", key)
+		}
+		for i := range pool {
+			if strings.TrimSpace(pool[i].Text) == "" {
+				return fmt.Errorf("%s reply #%d is empty", key, i+1)
+			}
+			if err := pool[i].parse(); err != nil {
+				return fmt.Errorf("%s reply #%d is invalid: %s", key, i+1, err)
+			}
+		}
+		if len(pool) > 0 && key != anniversaryReplies && !hasUnconditional(pool) {
+			return fmt.Errorf("%s replies have no phrase without conditions and the date of the message", key)
+		}
+	}
+	return nil
+}
+
+// loadDictionary reads and validates a dictionary file.
+func loadDictionary(path string) (*dictionary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := dictionary{}
+	if err = yaml.UnmarshalStrict(data, &d); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err = d.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &d, nil
+}
+
+// dictionaries structure.
+// Keeps dictionaries by language code, falling back to the default language.
+type dictionaries struct {
+	langs    map[string]*dictionary
+	fallback string
+}
+
+// loadDictionaries loads every <language>.yml file of the directory.
+// The dictionary of the fallback language must be among them.
+func loadDictionaries(dir string, fallback string) (*dictionaries, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+
+	d := dictionaries{map[string]*dictionary{}, fallback}
+	for _, path := range paths {
+		dict, err := loadDictionary(path)
+		if err != nil {
+			return nil, err
+		}
+		d.langs[strings.TrimSuffix(filepath.Base(path), ".yml")] = dict
+	}
+	if _, ok := d.langs[fallback]; !ok {
+		return nil, fmt.Errorf("no replies in %s for the default language %q", dir, fallback)
+	}
+	return &d, nil
+}
+
+// Has checks if there is a dictionary of the language.
+func (d *dictionaries) Has(lang string) bool {
+	_, ok := d.langs[lang]
+	return ok
+}
+
+// Languages returns codes of languages with dictionaries, sorted.
+func (d *dictionaries) Languages() []string {
+	langs := make([]string, 0, len(d.langs))
+	for lang := range d.langs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Pool returns phrases of the language kept under the key,
+// or ones of the default language if the language or the key is missing.
+func (d *dictionaries) Pool(lang string, key string) []phrase {
+	if dict, ok := d.langs[lang]; ok {
+		if pool := dict.pool(key); len(pool) > 0 {
+			return pool
+		}
+	}
+	return d.langs[d.fallback].pool(key)
+}
@@ -0,0 +1,96 @@
+package irwys
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeReplies(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func texts(pool []phrase) []string {
+	texts := []string{}
+	for _, p := range pool {
+		texts = append(texts, p.Text)
+	}
+	return texts
+}
+
+func TestLoadDictionaries(t *testing.T) {
+	dicts, err := loadDictionaries("../replies", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dicts.Languages(); !reflect.DeepEqual(got, []string{"en", "ru"}) {
+		t.Fatalf("Got languages %v, want [en ru]", got)
+	}
+
+	dir := writeReplies(t, map[string]string{
+		"en.yml":    "text: [hello]\nphoto: [nice]\nanniversary: ['{{.Years}} years']\n",
+		"de.yml":    "text: [hallo, {text: 'guten Morgen', weight: 2, when: {hours: [6, 11]}}]\nphoto: [schön]\n",
+		"notes.txt": "not a dictionary",
+	})
+	dicts, err = loadDictionaries(dir, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		lang, key string
+		want      []string
+	}{
+		{"de", textReplies, []string{"hallo", "guten Morgen"}},
+		// Missing keys and languages fall back to the default language.
+		{"de", anniversaryReplies, []string{"{{.Years}} years"}},
+		{"fr", photoReplies, []string{"nice"}},
+		{"", textReplies, []string{"hello"}},
+	} {
+		if got := texts(dicts.Pool(c.lang, c.key)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Pool(%q, %q) = %v, want %v", c.lang, c.key, got, c.want)
+		}
+	}
+}
+
+func TestLoadDictionariesValidates(t *testing.T) {
+	for name, c := range map[string]struct {
+		content string
+		want    string
+	}{
+		"missing photo": {"text: [hello]\n", "photo replies are missing"},
+		"empty text":    {"text: []\nphoto: [nice]\n", "text replies are missing"},
+		"empty phrase":  {"text: [hello, '  ']\nphoto: [nice]\n", "text reply #2 is empty"},
+		"unknown key":   {"text: [hello]\nphoto: [nice]\nvideo: [wow]\n", "video"},
+		"not a list":    {"text: hello\nphoto: [nice]\n", "unmarshal"},
+		"unknown field": {"text: [hello]\nphoto: ['{{.Nope}}']\n", "photo reply #1 is invalid"},
+		"bad template":  {"text: ['{{.Author']\nphoto: [nice]\n", "text reply #1 is invalid"},
+		"legacy years":  {"text: [hello]\nphoto: [nice]\nanniversary: ['%d years ago']\n", "use {{.Years}}"},
+		"conditional only": {
+			"text: [{text: hello, when: {max_days: 1}}]\nphoto: [nice]\n", "text replies have no phrase without conditions",
+		},
+		"negative weight":   {"text: [hello, {text: hi, weight: -1}]\nphoto: [nice]\n", "weight -1 is negative"},
+		"days":              {"text: [hello, {text: hi, when: {min_days: 7, max_days: 1}}]\nphoto: [nice]\n", "min_days 7"},
+		"hours":             {"text: [hello, {text: hi, when: {hours: [3]}}]\nphoto: [nice]\n", "pair of different hours"},
+		"type":              {"text: [hello, {text: hi, when: {types: [poem]}}]\nphoto: [nice]\n", "unknown message type \"poem\""},
+		"unknown condition": {"text: [hello, {text: hi, when: {weekday: 1}}]\nphoto: [nice]\n", "weekday"},
+	} {
+		dir := writeReplies(t, map[string]string{"en.yml": c.content})
+		if _, err := loadDictionaries(dir, "en"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v, want %q", name, err, c.want)
+		}
+	}
+
+	dir := writeReplies(t, map[string]string{"de.yml": "text: [hallo]\nphoto: [schön]\n"})
+	if _, err := loadDictionaries(dir, "en"); err == nil {
+		t.Error("Loaded dictionaries without the default language")
+	}
+}
@@ -0,0 +1,160 @@
+package irwys
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduleEntry is a chat waiting in the scheduler.
+type scheduleEntry struct {
+	chatID int64
+	at     time.Time
+	index  int
+}
+
+// scheduleQueue implements heap.Interface ordered by the time entries are due.
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// scheduler structure.
+// Keeps a single timer for the chat that is due first and calls fire
+// for every chat once its time comes. Each chat has at most one pending entry.
+type scheduler struct {
+	queue scheduleQueue
+	index map[int64]*scheduleEntry
+	wake  chan struct{}
+	fire  func(chatID int64)
+	fired *sync.WaitGroup
+	lock  *sync.Mutex
+}
+
+// newScheduler creates an object of scheduler structure.
+func newScheduler(fire func(chatID int64)) *scheduler {
+	lock := sync.Mutex{}
+	s := scheduler{
+		index: map[int64]*scheduleEntry{},
+		wake:  make(chan struct{}, 1),
+		fire:  fire,
+		fired: &sync.WaitGroup{},
+		lock:  &lock,
+	}
+	return &s
+}
+
+// Schedule makes the chat due at the given time, replacing its previous schedule.
+func (s *scheduler) Schedule(chatID int64, at time.Time) {
+	s.lock.Lock()
+	if e, ok := s.index[chatID]; ok {
+		e.at = at
+		heap.Fix(&s.queue, e.index)
+	} else {
+		e := &scheduleEntry{chatID: chatID, at: at}
+		heap.Push(&s.queue, e)
+		s.index[chatID] = e
+	}
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// Remove cancels the schedule of the chat.
+func (s *scheduler) Remove(chatID int64) {
+	s.lock.Lock()
+	if e, ok := s.index[chatID]; ok {
+		heap.Remove(&s.queue, e.index)
+		delete(s.index, chatID)
+	}
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// Len returns the number of scheduled chats.
+func (s *scheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.queue)
+}
+
+// notify wakes the run loop up to reconsider the earliest entry.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fires due chats until stop is closed, then waits for fired chats to be handled.
+// fire is called in its own goroutine, so a slow recall doesn't hold others back.
+func (s *scheduler) Run(stop <-chan struct{}) {
+	defer s.fired.Wait()
+
+	for {
+		var due []int64
+		var next time.Time
+
+		s.lock.Lock()
+		now := time.Now()
+		for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+			e := heap.Pop(&s.queue).(*scheduleEntry)
+			delete(s.index, e.chatID)
+			due = append(due, e.chatID)
+		}
+		if len(s.queue) > 0 {
+			next = s.queue[0].at
+		}
+		s.lock.Unlock()
+
+		for _, chatID := range due {
+			s.fired.Add(1)
+			go func(chatID int64) {
+				defer s.fired.Done()
+				s.fire(chatID)
+			}(chatID)
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			timeout = timer.C
+		}
+
+		select {
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
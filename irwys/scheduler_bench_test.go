@@ -0,0 +1,60 @@
+//go:build linux || darwin
+
+package irwys
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// cpuTime returns CPU time consumed by the process so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkSchedulerIdle measures CPU the scheduler burns while chats are waiting.
+// Every op is a millisecond of wall time; cpu-ns/op should not grow with the number of chats.
+func BenchmarkSchedulerIdle(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("chats=%d", n), func(b *testing.B) {
+			s := newScheduler(func(int64) {})
+			now := time.Now()
+			for i := 0; i < n; i++ {
+				s.Schedule(int64(i), now.Add(time.Hour+time.Duration(i)*time.Second))
+			}
+			stop := make(chan struct{})
+			defer close(stop)
+			go s.Run(stop)
+
+			b.ResetTimer()
+			before := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			used := cpuTime(b) - before
+			b.StopTimer()
+
+			b.ReportMetric(float64(used.Nanoseconds())/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// BenchmarkSchedulerSchedule measures rescheduling a chat when a message arrives.
+func BenchmarkSchedulerSchedule(b *testing.B) {
+	s := newScheduler(func(int64) {})
+	now := time.Now()
+	for i := 0; i < 10000; i++ {
+		s.Schedule(int64(i), now.Add(time.Hour+time.Duration(i)*time.Second))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Schedule(int64(i%10000), now.Add(time.Hour+time.Duration(i)*time.Millisecond))
+	}
+}
@@ -0,0 +1,79 @@
+package irwys
+
+import (
+	"testing"
+	"time"
+)
+
+func runScheduler(t *testing.T) (*scheduler, chan int64) {
+	fired := make(chan int64, 16)
+	s := newScheduler(func(chatID int64) { fired <- chatID })
+	stop := make(chan struct{})
+	go s.Run(stop)
+	t.Cleanup(func() { close(stop) })
+	return s, fired
+}
+
+func TestSchedulerFiresInOrder(t *testing.T) {
+	s, fired := runScheduler(t)
+	now := time.Now()
+
+	s.Schedule(1, now.Add(60*time.Millisecond))
+	s.Schedule(2, now.Add(20*time.Millisecond))
+	s.Schedule(3, now.Add(40*time.Millisecond))
+
+	for _, want := range []int64{2, 3, 1} {
+		select {
+		case got := <-fired:
+			if got != want {
+				t.Fatalf("Fired chat %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for chat %d", want)
+		}
+	}
+	if s.Len() != 0 {
+		t.Fatalf("Scheduler still has %d chats", s.Len())
+	}
+}
+
+func TestSchedulerRescheduleAndRemove(t *testing.T) {
+	s, fired := runScheduler(t)
+	now := time.Now()
+
+	s.Schedule(1, now.Add(20*time.Millisecond))
+	s.Schedule(1, now.Add(time.Hour))
+	s.Schedule(2, now.Add(20*time.Millisecond))
+	s.Remove(2)
+	s.Schedule(3, now.Add(40*time.Millisecond))
+
+	select {
+	case got := <-fired:
+		if got != 3 {
+			t.Fatalf("Fired chat %d, want 3", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for chat 3")
+	}
+	select {
+	case got := <-fired:
+		t.Fatalf("Unexpectedly fired chat %d", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Scheduler has %d chats, want 1", s.Len())
+	}
+}
+
+func TestSettingsNextActive(t *testing.T) {
+	s := Settings{TimeStart: 20, TimeEnd: 2, Location: time.UTC}
+	now := time.Date(2020, 1, 1, 3, 15, 0, 0, time.UTC)
+	if got, want := s.nextActive(now), time.Date(2020, 1, 1, 20, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("Next active moment is %s, want %s", got, want)
+	}
+
+	s = Settings{TimeStart: 0, TimeEnd: 0, Location: time.UTC}
+	if got, want := s.nextActive(now), now.Add(24*time.Hour); !got.Equal(want) {
+		t.Fatalf("Next check of an empty window is %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package irwys
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// selector picks the message to recall among candidates.
+type selector interface {
+	// weight tells how likely the message is picked, relatively to others.
+	weight(ref MessageRef, now time.Time) float64
+}
+
+type uniformSelector struct{}
+
+func (uniformSelector) weight(ref MessageRef, now time.Time) float64 {
+	return 1
+}
+
+// olderSelector favours older messages, the weight grows with age in days.
+// Messages of unknown date weigh as much as the ones posted today.
+type olderSelector struct{}
+
+func (olderSelector) weight(ref MessageRef, now time.Time) float64 {
+	if ref.Date == 0 {
+		return 1
+	}
+	days := now.Sub(ref.Time()).Hours() / 24
+	if days < 0 {
+		days = 0
+	}
+	return 1 + days
+}
+
+// popularSelector favours messages that got more replies.
+type popularSelector struct{}
+
+func (popularSelector) weight(ref MessageRef, now time.Time) float64 {
+	return 1 + float64(ref.Replies)
+}
+
+// narrower is implemented by selectors that prefer a subset of candidates whenever there is one.
+type narrower interface {
+	narrow(candidates []MessageRef, now time.Time) []MessageRef
+}
+
+// anniversarySelector prefers messages posted on the same calendar date in previous years,
+// in the time zone of now. Messages of February 29 are recalled on February 28 of common years.
+// If there are none, all messages are equally likely.
+type anniversarySelector struct {
+	uniformSelector
+}
+
+func (anniversarySelector) narrow(candidates []MessageRef, now time.Time) []MessageRef {
+	same := []MessageRef{}
+	for _, ref := range candidates {
+		if ref.Date != 0 && isAnniversary(ref.Time().In(now.Location()), now) {
+			same = append(same, ref)
+		}
+	}
+	return same
+}
+
+func isAnniversary(posted time.Time, now time.Time) bool {
+	if posted.Year() >= now.Year() {
+		return false
+	}
+	if posted.Month() == now.Month() && posted.Day() == now.Day() {
+		return true
+	}
+	return isLeapDay(posted) && isLastFebruaryDay(now)
+}
+
+func isLeapDay(t time.Time) bool {
+	return t.Month() == time.February && t.Day() == 29
+}
+
+func isLastFebruaryDay(t time.Time) bool {
+	return t.Month() == time.February && t.AddDate(0, 0, 1).Month() == time.March
+}
+
+// yearsAgo returns how many full calendar years passed since the message was posted.
+func yearsAgo(ref MessageRef, now time.Time) int {
+	return now.Year() - ref.Time().In(now.Location()).Year()
+}
+
+const anniversaryStrategy = "anniversary"
+
+// Selection strategies chats can choose from.
+var selectors = map[string]selector{
+	"uniform":           uniformSelector{},
+	"older":             olderSelector{},
+	"popular":           popularSelector{},
+	anniversaryStrategy: anniversarySelector{},
+}
+
+const defaultStrategy = "uniform"
+
+// strategyNames returns names of selection strategies in alphabetical order.
+func strategyNames() []string {
+	names := []string{}
+	for name := range selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func selectorOf(strategy string) selector {
+	if sel, ok := selectors[strategy]; ok {
+		return sel
+	}
+	return selectors[defaultStrategy]
+}
+
+// pick returns index of the candidate chosen with probability proportional to its weight.
+func pick(sel selector, candidates []MessageRef, now time.Time, random *rand.Rand) int {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, ref := range candidates {
+		weights[i] = sel.weight(ref, now)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return random.Intn(len(candidates))
+	}
+
+	x := random.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(candidates) - 1
+}
+
+// withoutRecent drops up to n most recently recalled candidates,
+// always leaving at least one of them.
+func withoutRecent(candidates []MessageRef, n int) []MessageRef {
+	if n <= 0 || len(candidates) <= 1 {
+		return candidates
+	}
+
+	recalled := []MessageRef{}
+	for _, ref := range candidates {
+		if ref.RecalledAt > 0 {
+			recalled = append(recalled, ref)
+		}
+	}
+	sort.Slice(recalled, func(i, j int) bool { return recalled[i].RecalledAt > recalled[j].RecalledAt })
+	if n > len(candidates)-1 {
+		n = len(candidates) - 1
+	}
+	if n > len(recalled) {
+		n = len(recalled)
+	}
+
+	recent := map[int]bool{}
+	for _, ref := range recalled[:n] {
+		recent[ref.ID] = true
+	}
+	kept := []MessageRef{}
+	for _, ref := range candidates {
+		if !recent[ref.ID] {
+			kept = append(kept, ref)
+		}
+	}
+	return kept
+}
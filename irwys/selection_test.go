@@ -0,0 +1,124 @@
+package irwys
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func pickCounts(sel selector, candidates []MessageRef, now time.Time, n int) map[int]int {
+	random := rand.New(rand.NewSource(1))
+	counts := map[int]int{}
+	for i := 0; i < n; i++ {
+		counts[candidates[pick(sel, candidates, now, random)].ID]++
+	}
+	return counts
+}
+
+func TestUniformSelector(t *testing.T) {
+	candidates := []MessageRef{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	counts := pickCounts(selectors["uniform"], candidates, time.Now(), 40000)
+	for _, ref := range candidates {
+		if c := counts[ref.ID]; c < 9500 || c > 10500 {
+			t.Fatalf("Message %d picked %d times out of 40000, want about 10000", ref.ID, c)
+		}
+	}
+}
+
+func TestOlderSelector(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	candidates := []MessageRef{
+		{ID: 1, Date: now.AddDate(-1, 0, 0).Unix()},
+		{ID: 2, Date: now.AddDate(0, -1, 0).Unix()},
+		{ID: 3, Date: now.Unix()},
+	}
+	counts := pickCounts(selectors["older"], candidates, now, 10000)
+	if !(counts[1] > counts[2] && counts[2] > counts[3]) {
+		t.Fatalf("Older messages aren't favoured: %v", counts)
+	}
+	// A year old message weighs 367, a month old one 32, today's one 1.
+	if c := counts[1]; c < 8900 || c > 9300 {
+		t.Fatalf("Year old message picked %d times out of 10000, want about 9150", c)
+	}
+}
+
+func TestPopularSelector(t *testing.T) {
+	candidates := []MessageRef{{ID: 1, Replies: 9}, {ID: 2}, {ID: 3, Replies: 4}}
+	counts := pickCounts(selectors["popular"], candidates, time.Now(), 16000)
+	// Weights are 10, 1 and 5.
+	for id, want := range map[int]int{1: 10000, 2: 1000, 3: 5000} {
+		if c := counts[id]; c < want*9/10 || c > want*11/10 {
+			t.Fatalf("Message %d picked %d times out of 16000, want about %d", id, c, want)
+		}
+	}
+}
+
+func TestWithoutRecent(t *testing.T) {
+	candidates := []MessageRef{
+		{ID: 1, RecalledAt: 300},
+		{ID: 2},
+		{ID: 3, RecalledAt: 100},
+		{ID: 4, RecalledAt: 200},
+	}
+
+	ids := func(refs []MessageRef) []int {
+		r := []int{}
+		for _, ref := range refs {
+			r = append(r, ref.ID)
+		}
+		return r
+	}
+
+	cases := []struct {
+		n    int
+		want []int
+	}{
+		{0, []int{1, 2, 3, 4}},
+		{1, []int{2, 3, 4}},
+		{2, []int{2, 3}},
+		{3, []int{2}},
+		{10, []int{2}},
+	}
+	for _, c := range cases {
+		got := ids(withoutRecent(candidates, c.n))
+		if len(got) != len(c.want) {
+			t.Fatalf("Without %d recent got %v, want %v", c.n, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("Without %d recent got %v, want %v", c.n, got, c.want)
+			}
+		}
+	}
+
+	// Never leaves no candidates even if all of them were recalled.
+	all := []MessageRef{{ID: 1, RecalledAt: 1}, {ID: 2, RecalledAt: 2}}
+	if got := ids(withoutRecent(all, 5)); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("Got %v, want [1]", got)
+	}
+}
+
+func TestAnniversarySelectorNarrow(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	now := time.Date(2021, 2, 28, 10, 0, 0, 0, tokyo)
+	candidates := []MessageRef{
+		{ID: 1, Date: time.Date(2019, 2, 28, 12, 0, 0, 0, tokyo).Unix()},
+		// Still February 27 in UTC, but February 28 in Tokyo.
+		{ID: 2, Date: time.Date(2020, 2, 27, 20, 0, 0, 0, time.UTC).Unix()},
+		// Leap day is recalled on February 28 of common years.
+		{ID: 3, Date: time.Date(2020, 2, 29, 12, 0, 0, 0, tokyo).Unix()},
+		{ID: 4, Date: time.Date(2020, 3, 28, 12, 0, 0, 0, tokyo).Unix()},
+		// Posted earlier today.
+		{ID: 5, Date: time.Date(2021, 2, 28, 8, 0, 0, 0, tokyo).Unix()},
+		// Unknown date.
+		{ID: 6},
+	}
+
+	same := anniversarySelector{}.narrow(candidates, now)
+	if len(same) != 3 || same[0].ID != 1 || same[1].ID != 2 || same[2].ID != 3 {
+		t.Fatalf("Got anniversaries %v", same)
+	}
+	if years := yearsAgo(same[0], now); years != 2 {
+		t.Fatalf("Message posted %d years ago, want 2", years)
+	}
+}
@@ -0,0 +1,138 @@
+package irwys
+
+import (
+	"sync"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// session structure.
+// Owns the channel updates of a chat are delivered to and the goroutine handling them.
+// Only the session closes its channel, and never while an update is being delivered.
+type session struct {
+	updates chan tgbotapi.Update
+	done    chan struct{}
+	closed  bool
+	lock    *sync.Mutex
+}
+
+// newSession creates an object of session structure and starts handle in its goroutine.
+// handle must return once the updates channel is closed.
+func newSession(handle func(updates <-chan tgbotapi.Update)) *session {
+	lock := sync.Mutex{}
+	s := session{
+		updates: make(chan tgbotapi.Update, 1),
+		done:    make(chan struct{}),
+		lock:    &lock,
+	}
+	go func() {
+		defer close(s.done)
+		handle(s.updates)
+	}()
+	return &s
+}
+
+// deliver passes the update to the session, unless it is stopped.
+func (s *session) deliver(update tgbotapi.Update) bool {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.updates <- update
+	return true
+}
+
+// stop closes the session and waits for updates delivered before to be handled.
+// It's safe to call more than once.
+func (s *session) stop() {
+	(*s.lock).Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.updates)
+	}
+	(*s.lock).Unlock()
+
+	<-s.done
+}
+
+// sessions structure.
+// Keeps a session per chat the bot is started in.
+type sessions struct {
+	data map[int64]*session
+	lock *sync.Mutex
+}
+
+// newSessions creates an object of sessions structure.
+func newSessions() *sessions {
+	lock := sync.Mutex{}
+	s := sessions{map[int64]*session{}, &lock}
+	return &s
+}
+
+// Start starts a session of the chat handling its updates with handle.
+// Returns false if the chat already has a session, which is left running.
+func (s *sessions) Start(chatID int64, handle func(updates <-chan tgbotapi.Update)) bool {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	if _, ok := s.data[chatID]; ok {
+		return false
+	}
+	s.data[chatID] = newSession(handle)
+	return true
+}
+
+// Stop stops the session of the chat, waiting for updates delivered before to be handled.
+// Returns false if the chat has no session.
+func (s *sessions) Stop(chatID int64) bool {
+	(*s.lock).Lock()
+	sess, ok := s.data[chatID]
+	delete(s.data, chatID)
+	(*s.lock).Unlock()
+
+	if ok {
+		sess.stop()
+	}
+	return ok
+}
+
+// StopAll stops sessions of all chats and waits for them.
+func (s *sessions) StopAll() {
+	(*s.lock).Lock()
+	stopping := s.data
+	s.data = map[int64]*session{}
+	(*s.lock).Unlock()
+
+	for _, sess := range stopping {
+		sess.stop()
+	}
+}
+
+// Deliver passes the update to the session of the chat.
+// Returns false if the chat has no session.
+func (s *sessions) Deliver(chatID int64, update tgbotapi.Update) bool {
+	(*s.lock).Lock()
+	sess, ok := s.data[chatID]
+	(*s.lock).Unlock()
+
+	return ok && sess.deliver(update)
+}
+
+// Exist checks if the chat has a session.
+func (s *sessions) Exist(chatID int64) bool {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	_, ok := s.data[chatID]
+	return ok
+}
+
+// Len returns the number of running sessions.
+func (s *sessions) Len() int {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	return len(s.data)
+}
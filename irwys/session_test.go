@@ -0,0 +1,80 @@
+package irwys
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+func TestSessionsLifecycle(t *testing.T) {
+	s := newSessions()
+	var handled int32
+	handle := func(updates <-chan tgbotapi.Update) {
+		for range updates {
+			atomic.AddInt32(&handled, 1)
+		}
+	}
+
+	if s.Deliver(1, tgbotapi.Update{}) {
+		t.Fatal("Delivered to a chat without session")
+	}
+	if !s.Start(1, handle) || s.Start(1, handle) {
+		t.Fatal("Start isn't idempotent")
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Got %d sessions, want 1", s.Len())
+	}
+	if !s.Deliver(1, tgbotapi.Update{}) {
+		t.Fatal("Can't deliver to a started chat")
+	}
+
+	if !s.Stop(1) || s.Stop(1) {
+		t.Fatal("Stop isn't idempotent")
+	}
+	// Stop waits for delivered updates to be handled.
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("Handled %d updates, want 1", n)
+	}
+	if s.Exist(1) || s.Deliver(1, tgbotapi.Update{}) {
+		t.Fatal("Session is alive after stop")
+	}
+
+	if !s.Start(1, handle) {
+		t.Fatal("Can't restart a stopped chat")
+	}
+	s.StopAll()
+	if s.Len() != 0 {
+		t.Fatalf("Got %d sessions after StopAll, want 0", s.Len())
+	}
+}
+
+func TestSessionsConcurrentStartStop(t *testing.T) {
+	s := newSessions()
+	handle := func(updates <-chan tgbotapi.Update) {
+		for range updates {
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				chatID := int64(j % 4)
+				switch (i + j) % 3 {
+				case 0:
+					s.Start(chatID, handle)
+				case 1:
+					s.Stop(chatID)
+				default:
+					s.Deliver(chatID, tgbotapi.Update{})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.StopAll()
+}
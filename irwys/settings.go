@@ -0,0 +1,546 @@
+package irwys
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// Settings are the parameters the bot works with in a chat.
+// Options provide the defaults, chats may override any of them.
+type Settings struct {
+	MinWords  int
+	MaxWords  int
+	Timeout   int
+	TimeStart int
+	TimeEnd   int
+	Capacity  int
+	// Probability of recall in percent.
+	Probability int
+	// MinInterval between recalls in minutes.
+	MinInterval int
+	// MaxPerDay recalls, 0 means unlimited.
+	MaxPerDay int
+	// Jitter of recall time in minutes.
+	Jitter int
+	// NoRepeat excludes this many last recalled messages from selection.
+	NoRepeat int
+	// OwnReplies makes the bot reply with phrases of the chat only, if it has any,
+	// instead of mixing them with common ones.
+	OwnReplies int
+	// Strategy names the selector picking messages to recall.
+	Strategy string
+	// Location is the time zone TimeStart and TimeEnd are hours of.
+	Location *time.Location
+}
+
+// settingDef describes a setting chats can override.
+type settingDef struct {
+	name  string
+	help  string
+	min   int
+	max   int
+	step  int
+	field func(s *Settings) *int
+}
+
+var settingDefs = []settingDef{
+	{"minWords", "Minimal message length (in words)", 0, math.MaxUint16, 5,
+		func(s *Settings) *int { return &s.MinWords }},
+	{"maxWords", "Maximal message length (in words)", 0, math.MaxUint16, 5,
+		func(s *Settings) *int { return &s.MaxWords }},
+	{"timeout", "Silence before recall (in minutes)", 1, math.MaxInt16, 5,
+		func(s *Settings) *int { return &s.Timeout }},
+	{"timeStart", "Hour to start recalling", 0, 23, 1,
+		func(s *Settings) *int { return &s.TimeStart }},
+	{"timeEnd", "Hour to stop recalling", 0, 24, 1,
+		func(s *Settings) *int { return &s.TimeEnd }},
+	{"capacity", "Messages to remember", 1, math.MaxUint16, 128,
+		func(s *Settings) *int { return &s.Capacity }},
+	{"probability", "Chance of recall (in percent)", 0, 100, 5,
+		func(s *Settings) *int { return &s.Probability }},
+	{"minInterval", "Minimal interval between recalls (in minutes)", 0, math.MaxUint16, 15,
+		func(s *Settings) *int { return &s.MinInterval }},
+	{"maxPerDay", "Recalls per day (0 is unlimited)", 0, math.MaxUint16, 1,
+		func(s *Settings) *int { return &s.MaxPerDay }},
+	{"jitter", "Random delay of recall (in minutes)", 0, math.MaxUint16, 5,
+		func(s *Settings) *int { return &s.Jitter }},
+	{"noRepeat", "Last recalled messages not to repeat", 0, math.MaxUint16, 1,
+		func(s *Settings) *int { return &s.NoRepeat }},
+	{"ownReplies", "Reply with chat phrases only (0 mixes them with common ones)", 0, 1, 1,
+		func(s *Settings) *int { return &s.OwnReplies }},
+}
+
+const settingsCallback = "settings"
+
+func findSettingDef(name string) (settingDef, bool) {
+	for _, def := range settingDefs {
+		if strings.EqualFold(def.name, name) {
+			return def, true
+		}
+	}
+	return settingDef{}, false
+}
+
+// defaults returns settings given by options.
+func (o *Options) defaults() Settings {
+	return Settings{
+		MinWords:  int(o.MinWords),
+		MaxWords:  int(o.MaxWords),
+		Timeout:   int(o.Timeout),
+		TimeStart: int(o.TimeStart),
+		TimeEnd:   int(o.TimeEnd),
+		Capacity:  int(o.Capacity),
+		Location:  time.Local,
+
+		Probability: int(o.Probability),
+		MinInterval: int(o.MinInterval),
+		MaxPerDay:   int(o.MaxPerDay),
+		Jitter:      int(o.Jitter),
+		NoRepeat:    int(o.NoRepeat),
+		Strategy:    o.Strategy,
+	}
+}
+
+// settingsOf returns effective settings of the chat.
+func (o *Options) settingsOf(conf ChatConfig) Settings {
+	s := o.defaults()
+	for _, def := range settingDefs {
+		if v, ok := conf.Settings[def.name]; ok {
+			*def.field(&s) = v
+		}
+	}
+	if _, ok := selectors[conf.Strategy]; ok {
+		s.Strategy = conf.Strategy
+	}
+	if conf.Timezone != "" {
+		loc, err := loadLocation(conf.Timezone)
+		if err != nil {
+			Log.Error("Can't load chat time zone", "timezone", conf.Timezone, "error", err)
+		} else {
+			s.Location = loc
+		}
+	}
+	return s
+}
+
+// locations caches time zones by name, as time.LoadLocation reads zoneinfo on every call.
+var locations = struct {
+	zones map[string]*time.Location
+	lock  sync.RWMutex
+}{zones: map[string]*time.Location{}}
+
+// loadLocation returns the time zone with the name, loading it once.
+func loadLocation(name string) (*time.Location, error) {
+	locations.lock.RLock()
+	loc, ok := locations.zones[name]
+	locations.lock.RUnlock()
+	if ok {
+		return loc, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.lock.Lock()
+	locations.zones[name] = loc
+	locations.lock.Unlock()
+	return loc, nil
+}
+
+// active tells if the bot may recall at the given moment.
+// The window starts at TimeStart and ends before TimeEnd in the chat's time zone,
+// wrapping past midnight when TimeStart is greater than TimeEnd.
+// Equal hours make an empty window.
+func (s Settings) active(now time.Time) bool {
+	hour := now.In(s.Location).Hour()
+	if s.TimeStart <= s.TimeEnd {
+		return hour >= s.TimeStart && hour < s.TimeEnd
+	}
+	return hour >= s.TimeStart || hour < s.TimeEnd
+}
+
+// nextActive returns the moment the recall window opens next after now.
+// If the window is empty, the chat is checked again in a day.
+func (s Settings) nextActive(now time.Time) time.Time {
+	local := now.In(s.Location)
+	t := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, s.Location)
+	for i := 0; i < 48; i++ {
+		t = t.Add(time.Hour)
+		if s.active(t) {
+			return t
+		}
+	}
+	return now.Add(24 * time.Hour)
+}
+
+// validate checks settings are consistent with each other.
+func (s Settings) validate() error {
+	if s.MinWords > s.MaxWords {
+		return fmt.Errorf("minWords (%d) can't be greater than maxWords (%d)", s.MinWords, s.MaxWords)
+	}
+	return nil
+}
+
+// setOverride sets or, if value is nil, resets the chat's override of a setting.
+func (o *Options) setOverride(conf *ChatConfig, def settingDef, value *int) error {
+	overrides := map[string]int{}
+	for k, v := range conf.Settings {
+		overrides[k] = v
+	}
+
+	if value == nil {
+		delete(overrides, def.name)
+	} else {
+		if *value < def.min || *value > def.max {
+			return fmt.Errorf("%s must be between %d and %d", def.name, def.min, def.max)
+		}
+		overrides[def.name] = *value
+	}
+
+	next := *conf
+	next.Settings = overrides
+	if err := o.settingsOf(next).validate(); err != nil {
+		return err
+	}
+	if len(overrides) == 0 {
+		next.Settings = nil
+	}
+	*conf = next
+
+	return nil
+}
+
+// isAdmin checks if the user may change settings of the chat.
+func isAdmin(botAPI Messenger, chat *tgbotapi.Chat, userID int) bool {
+	if chat.IsPrivate() || chat.AllMembersAreAdmins {
+		return true
+	}
+
+	member, err := botAPI.ChatMember(chat.ID, userID)
+	if err != nil {
+		Log.Error("Can't get chat member", "chat_id", chat.ID, "user_id", userID, "error", err)
+		return false
+	}
+
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+func (b bot) settingsText(conf ChatConfig) string {
+	s := b.opts().settingsOf(conf)
+	lines := []string{"*Settings*", ""}
+	for _, def := range settingDefs {
+		line := fmt.Sprintf("%s: `%d`", def.help, *def.field(&s))
+		if _, ok := conf.Settings[def.name]; !ok {
+			line += " (default)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("Time zone: `%s`", s.Location))
+	lines = append(lines, fmt.Sprintf("Selection strategy: `%s`", s.Strategy))
+	lines = append(lines, "",
+		"Admins can change a setting with the buttons below or with `/settings <name> <value>`. "+
+			"Press the value to reset it to default.")
+
+	return strings.Join(lines, "\n")
+}
+
+func (b bot) settingsKeyboard(conf ChatConfig) tgbotapi.InlineKeyboardMarkup {
+	s := b.opts().settingsOf(conf)
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, def := range settingDefs {
+		data := func(op string) string {
+			return strings.Join([]string{settingsCallback, def.name, op}, " ")
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("−", data("dec")),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s: %d", def.name, *def.field(&s)), data("reset")),
+			tgbotapi.NewInlineKeyboardButtonData("+", data("inc")),
+		))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// settings shows settings of the chat or, given `<name> <value>` arguments, changes one of them.
+func (b bot) settings(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat information", "chat_id", chatID, "error", err)
+		return
+	}
+	if !ok {
+		say(botAPI, chatID, "Start the bot with /start first.")
+		return
+	}
+
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) > 0 {
+		if !isAdmin(botAPI, update.Message.Chat, update.Message.From.ID) {
+			say(botAPI, chatID, "Only chat administrators can change settings.")
+			return
+		}
+		if len(args) != 2 {
+			say(botAPI, chatID, "Usage: /settings <name> <value>")
+			return
+		}
+		def, ok := findSettingDef(args[0])
+		if !ok {
+			say(botAPI, chatID, fmt.Sprintf("Unknown setting %s", args[0]))
+			return
+		}
+		var value *int
+		if args[1] != "default" {
+			v, err := strconv.Atoi(args[1])
+			if err != nil {
+				say(botAPI, chatID, fmt.Sprintf("%s is not a number", args[1]))
+				return
+			}
+			value = &v
+		}
+		var invalid error
+		err := dbChats.Update(chatID, func(c *ChatConfig) error {
+			if invalid = b.opts().setOverride(c, def, value); invalid != nil {
+				return invalid
+			}
+			conf = *c
+			return nil
+		})
+		if invalid != nil {
+			say(botAPI, chatID, fmt.Sprintf("Can't change setting: %s", invalid))
+			return
+		}
+		if err != nil {
+			Log.Error("Can't save settings", "chat_id", chatID, "error", err)
+			return
+		}
+		Log.Info("Setting changed", "chat_id", chatID, "setting", def.name, "value", args[1])
+	}
+
+	msg := tgbotapi.NewMessage(chatID, b.settingsText(conf))
+	msg.ParseMode = "markdown"
+	msg.ReplyMarkup = b.settingsKeyboard(conf)
+	if _, err := botAPI.Send(msg); err != nil {
+		Log.Error("Can't send settings", "chat_id", chatID, "error", err)
+	}
+}
+
+// settingsButton handles presses on the settings keyboard.
+func (b bot) settingsButton(dbChats ChatStore, query *tgbotapi.CallbackQuery, botAPI Messenger) {
+	answer := func(text string) {
+		if err := botAPI.AnswerCallback(query.ID, text); err != nil {
+			Log.Error("Can't answer callback query", "error", err)
+		}
+	}
+
+	args := strings.Fields(query.Data)
+	if query.Message == nil || len(args) != 3 {
+		answer("")
+		return
+	}
+	chatID := query.Message.Chat.ID
+
+	if !isAdmin(botAPI, query.Message.Chat, query.From.ID) {
+		answer("Only chat administrators can change settings.")
+		return
+	}
+
+	def, ok := findSettingDef(args[1])
+	if !ok {
+		answer(fmt.Sprintf("Unknown setting %s", args[1]))
+		return
+	}
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil || !ok {
+		answer("Start the bot with /start first.")
+		return
+	}
+
+	// The value is stepped from the one saved, not the one the keyboard was shown with.
+	var invalid error
+	err = dbChats.Update(chatID, func(c *ChatConfig) error {
+		s := b.opts().settingsOf(*c)
+		var value *int
+		switch v := *def.field(&s); args[2] {
+		case "inc":
+			if v += def.step; v > def.max {
+				v = def.max
+			}
+			value = &v
+		case "dec":
+			if v -= def.step; v < def.min {
+				v = def.min
+			}
+			value = &v
+		}
+		if invalid = b.opts().setOverride(c, def, value); invalid != nil {
+			return invalid
+		}
+		conf = *c
+		return nil
+	})
+	if invalid != nil {
+		answer(invalid.Error())
+		return
+	}
+	if err != nil {
+		Log.Error("Can't save settings", "chat_id", chatID, "error", err)
+		answer("Can't save settings")
+		return
+	}
+	answer("")
+
+	keyboard := b.settingsKeyboard(conf)
+	edit := tgbotapi.NewEditMessageText(chatID, query.Message.MessageID, b.settingsText(conf))
+	edit.ParseMode = "markdown"
+	edit.ReplyMarkup = &keyboard
+	if _, err := botAPI.Send(edit); err != nil {
+		Log.Error("Can't update settings message", "chat_id", chatID, "error", err)
+	}
+}
+
+// timezone shows the time zone of the chat or, given an IANA time zone name, changes it.
+func (b bot) timezone(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat information", "chat_id", chatID, "error", err)
+		return
+	}
+	if !ok {
+		say(botAPI, chatID, "Start the bot with /start first.")
+		return
+	}
+
+	name := strings.TrimSpace(update.Message.CommandArguments())
+	if name == "" {
+		say(botAPI, chatID, fmt.Sprintf(
+			"Time zone of the chat is %s. Change it with /timezone <name>, e.g. /timezone Europe/Moscow",
+			b.opts().settingsOf(conf).Location))
+		return
+	}
+	if !isAdmin(botAPI, update.Message.Chat, update.Message.From.ID) {
+		say(botAPI, chatID, "Only chat administrators can change settings.")
+		return
+	}
+
+	loc, err := loadLocation(name)
+	if err != nil || name == "Local" {
+		say(botAPI, chatID, fmt.Sprintf("Unknown time zone %s", name))
+		return
+	}
+
+	err = dbChats.Update(chatID, func(conf *ChatConfig) error {
+		conf.Timezone = loc.String()
+		return nil
+	})
+	if err != nil {
+		Log.Error("Can't save time zone", "chat_id", chatID, "error", err)
+		return
+	}
+	Log.Info("Time zone changed", "chat_id", chatID, "timezone", loc.String())
+	say(botAPI, chatID, fmt.Sprintf("Time zone of the chat is set to %s, it's %s there now.",
+		loc.String(), time.Now().In(loc).Format("15:04")))
+}
+
+// strategy shows the selection strategy of the chat or, given its name, changes it.
+func (b bot) strategy(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger) {
+	chatID := update.Message.Chat.ID
+
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat information", "chat_id", chatID, "error", err)
+		return
+	}
+	if !ok {
+		say(botAPI, chatID, "Start the bot with /start first.")
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+	if name == "" {
+		say(botAPI, chatID, fmt.Sprintf(
+			"Selection strategy of the chat is %s. Change it with /strategy <name>, one of: %s.\n"+
+				"Use /settings noRepeat <n> to avoid repeating the last n recalled messages.",
+			b.opts().settingsOf(conf).Strategy, strings.Join(strategyNames(), ", ")))
+		return
+	}
+	if !isAdmin(botAPI, update.Message.Chat, update.Message.From.ID) {
+		say(botAPI, chatID, "Only chat administrators can change settings.")
+		return
+	}
+	if _, ok := selectors[name]; !ok {
+		say(botAPI, chatID, fmt.Sprintf("Unknown strategy %s, use one of: %s.",
+			name, strings.Join(strategyNames(), ", ")))
+		return
+	}
+
+	err = dbChats.Update(chatID, func(conf *ChatConfig) error {
+		conf.Strategy = name
+		return nil
+	})
+	if err != nil {
+		Log.Error("Can't save strategy", "chat_id", chatID, "error", err)
+		return
+	}
+	Log.Info("Strategy changed", "chat_id", chatID, "strategy", name)
+	say(botAPI, chatID, fmt.Sprintf("Selection strategy of the chat is set to %s.", name))
+}
+
+// lang shows the language of the chat and available ones or, given a language code, changes it.
+func (b bot) lang(dbChats ChatStore, update tgbotapi.Update, botAPI Messenger, code string) {
+	chatID := update.Message.Chat.ID
+
+	conf, ok, err := dbChats.Get(chatID)
+	if err != nil {
+		Log.Error("Can't get chat information", "chat_id", chatID, "error", err)
+		return
+	}
+	if !ok {
+		say(botAPI, chatID, "Start the bot with /start first.")
+		return
+	}
+
+	cfg := b.config.get()
+	dicts := cfg.dicts
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		current := conf.Language
+		if !dicts.Has(current) {
+			current = fmt.Sprintf("%s, replying in %s as there are no replies in it", current, cfg.opts.Language)
+		}
+		say(botAPI, chatID, fmt.Sprintf(
+			"Language of the chat is %s. Change it with /lang <code>, one of: %s.",
+			current, strings.Join(dicts.Languages(), ", ")))
+		return
+	}
+	if !isAdmin(botAPI, update.Message.Chat, update.Message.From.ID) {
+		say(botAPI, chatID, "Only chat administrators can change settings.")
+		return
+	}
+	if !dicts.Has(code) {
+		say(botAPI, chatID, fmt.Sprintf("Unknown language %s, use one of: %s.",
+			code, strings.Join(dicts.Languages(), ", ")))
+		return
+	}
+
+	if err = b.language(dbChats, chatID, code); err != nil {
+		return
+	}
+	Log.Info("Language changed", "chat_id", chatID, "language", code)
+	say(botAPI, chatID, fmt.Sprintf("Language of the chat is set to %s.", code))
+}
+
+func say(botAPI Messenger, chatID int64, text string) {
+	if _, err := botAPI.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		Log.Error("Can't send message", "chat_id", chatID, "error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package irwys
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettingsActive(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		start, end int
+		loc        *time.Location
+		utcHour    int
+		active     bool
+	}{
+		{9, 23, time.UTC, 8, false},
+		{9, 23, time.UTC, 9, true},
+		{9, 23, time.UTC, 22, true},
+		{9, 23, time.UTC, 23, false},
+		{20, 2, time.UTC, 19, false},
+		{20, 2, time.UTC, 20, true},
+		{20, 2, time.UTC, 0, true},
+		{20, 2, time.UTC, 1, true},
+		{20, 2, time.UTC, 2, false},
+		{0, 0, time.UTC, 12, false},
+		{0, 24, time.UTC, 0, true},
+		// 23:00 UTC is 08:00 in Tokyo.
+		{9, 23, tokyo, 23, false},
+		// 00:00 UTC is 09:00 in Tokyo.
+		{9, 23, tokyo, 0, true},
+	}
+
+	for _, c := range cases {
+		s := Settings{TimeStart: c.start, TimeEnd: c.end, Location: c.loc}
+		now := time.Date(2020, 1, 1, c.utcHour, 30, 0, 0, time.UTC)
+		if got := s.active(now); got != c.active {
+			t.Errorf("Window %d-%d in %s at %02d:30 UTC: active %t, want %t",
+				c.start, c.end, c.loc, c.utcHour, got, c.active)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	valid := Options{
+		MinWords: 2, MaxWords: 100, Timeout: 30, TimeStart: 9, TimeEnd: 23, Capacity: 16, Probability: 30,
+		Strategy: "uniform", Storage: LevelStorage, DBPath: "db", ReplyPath: "replies", Language: "en",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Valid options rejected: %s", err)
+	}
+
+	for name, change := range map[string]func(o *Options){
+		"minWords > maxWords":  func(o *Options) { o.MinWords = 200 },
+		"empty window":         func(o *Options) { o.TimeEnd = 9 },
+		"timeStart > 23":       func(o *Options) { o.TimeStart = 24 },
+		"probability > 100":    func(o *Options) { o.Probability = 130 },
+		"relative webhook":     func(o *Options) { o.Webhook = "/hook" },
+		"cert without key":     func(o *Options) { o.TLSCert = "cert.pem" },
+		"health without admin": func(o *Options) { o.Health = true },
+	} {
+		o := valid
+		change(&o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("%s: options accepted", name)
+		}
+	}
+}
+
+func TestLoadLocationCaches(t *testing.T) {
+	first, err := loadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := loadLocation("Europe/Moscow"); second != first {
+		t.Fatal("Time zone is loaded again")
+	}
+	if _, err = loadLocation("Mars/Olympus"); err == nil {
+		t.Fatal("Loaded an unknown time zone")
+	}
+}
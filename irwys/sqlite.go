@@ -0,0 +1,373 @@
+package irwys
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// Registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS chats (
+	id     INTEGER PRIMARY KEY,
+	config TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	chat_id     INTEGER NOT NULL,
+	id          INTEGER NOT NULL,
+	author_id   INTEGER NOT NULL DEFAULT 0,
+	author      TEXT NOT NULL DEFAULT '',
+	author_name TEXT NOT NULL DEFAULT '',
+	date        INTEGER NOT NULL DEFAULT 0,
+	type        TEXT NOT NULL DEFAULT '',
+	text        TEXT NOT NULL DEFAULT '',
+	file_ids    TEXT,
+	reply_to_id INTEGER NOT NULL DEFAULT 0,
+	replies     INTEGER NOT NULL DEFAULT 0,
+	recalled    INTEGER NOT NULL DEFAULT 0,
+	recalled_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS messages_chat ON messages (chat_id, id);
+CREATE INDEX IF NOT EXISTS messages_author ON messages (chat_id, author_id);
+CREATE INDEX IF NOT EXISTS messages_date ON messages (chat_id, date);
+CREATE INDEX IF NOT EXISTS messages_type ON messages (chat_id, type);
+`
+
+const messageColumns = `id, author_id, author, author_name, date, type, text,
+	file_ids, reply_to_id, replies, recalled, recalled_at`
+
+// sqliteStore structure.
+// Implements Store in an SQLite database, keeping a row per remembered message,
+// so messages can be queried without loading whole chats.
+// Messages of a chat are ordered by rowid, which grows with every insert.
+type sqliteStore struct {
+	db   *sql.DB
+	lock *sync.Mutex
+}
+
+// NewSQLiteStore creates a Store kept in the irwys.sqlite database under path.
+func NewSQLiteStore(path string) (Store, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(path, "irwys.sqlite")+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writes, which SQLite can't run concurrently anyway.
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	lock := sync.Mutex{}
+	return sqliteStore{db, &lock}, nil
+}
+
+func (s sqliteStore) Messages() MessageStore {
+	return sqliteMessageStore{s}
+}
+
+func (s sqliteStore) Chats() ChatStore {
+	return sqliteChatStore{s}
+}
+
+func (s sqliteStore) Close() {
+	if err := s.db.Close(); err != nil {
+		Log.Error("Can't close database", "error", err)
+	}
+}
+
+// Compact rebuilds the database file, reclaiming space of deleted rows.
+func (s sqliteStore) Compact() error {
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+func (s sqliteStore) Stats() ([]StoreStat, error) {
+	stats := []StoreStat{}
+	for _, pragma := range []string{"page_count", "page_size", "freelist_count"} {
+		var v int64
+		if err := s.db.QueryRow("PRAGMA " + pragma).Scan(&v); err != nil {
+			return nil, err
+		}
+		stats = append(stats, StoreStat{pragma, v})
+	}
+	stats = append(stats, StoreStat{"size_bytes", stats[0].Value * stats[1].Value})
+	return stats, nil
+}
+
+// transact runs fn in a transaction, committing it unless fn fails.
+func (s sqliteStore) transact(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ids returns chat identifiers selected by the query.
+func (s sqliteStore) ids(query string) (ids []int64, err error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+type sqliteChatStore struct {
+	sqliteStore
+}
+
+func (s sqliteChatStore) Get(chatID int64) (conf ChatConfig, ok bool, err error) {
+	var data string
+	err = s.db.QueryRow("SELECT config FROM chats WHERE id = ?", chatID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return conf, false, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(data), &conf); err != nil {
+		Log.Error("Can't decode chat config", "chat_id", chatID, "error", err)
+		return
+	}
+
+	return conf, true, nil
+}
+
+func (s sqliteChatStore) Put(chatID int64, conf ChatConfig) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	return s.put(chatID, conf)
+}
+
+// put saves configuration of the chat, the lock must be held.
+func (s sqliteChatStore) put(chatID int64, conf ChatConfig) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO chats (id, config) VALUES (?, ?)", chatID, string(data))
+	return err
+}
+
+func (s sqliteChatStore) Update(chatID int64, fn func(conf *ChatConfig) error) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	conf, ok, err := s.Get(chatID)
+	if err != nil || !ok {
+		return err
+	}
+	if err = fn(&conf); err != nil {
+		return err
+	}
+	return s.put(chatID, conf)
+}
+
+// Delete waits for updates in progress, so they can't bring the chat back.
+func (s sqliteChatStore) Delete(chatID int64) error {
+	(*s.lock).Lock()
+	defer (*s.lock).Unlock()
+
+	_, err := s.db.Exec("DELETE FROM chats WHERE id = ?", chatID)
+	return err
+}
+
+func (s sqliteChatStore) Exist(chatID int64) (bool, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM chats WHERE id = ?", chatID).Scan(&n)
+	return n > 0, err
+}
+
+func (s sqliteChatStore) IDs() ([]int64, error) {
+	return s.ids("SELECT id FROM chats ORDER BY id")
+}
+
+// Migrate has nothing to upgrade, there are no legacy SQLite databases.
+func (s sqliteChatStore) Migrate() (int, error) {
+	return 0, nil
+}
+
+type sqliteMessageStore struct {
+	sqliteStore
+}
+
+func (s sqliteMessageStore) Get(chatID int64) ([]MessageRef, error) {
+	return s.Query(chatID, MessageQuery{})
+}
+
+func (s sqliteMessageStore) Put(chatID int64, refs []MessageRef) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM messages WHERE chat_id = ?", chatID); err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if err := insertMessage(tx, chatID, ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s sqliteMessageStore) Append(chatID int64, ref MessageRef, capacity int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if err := insertMessage(tx, chatID, ref); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM messages WHERE chat_id = ? AND rowid NOT IN (
+			SELECT rowid FROM messages WHERE chat_id = ? ORDER BY rowid DESC LIMIT ?
+		)`, chatID, chatID, capacity)
+		return err
+	})
+}
+
+func (s sqliteMessageStore) Remove(chatID int64, messageID int) error {
+	_, err := s.db.Exec("DELETE FROM messages WHERE chat_id = ? AND id = ?", chatID, messageID)
+	return err
+}
+
+func (s sqliteMessageStore) CountReply(chatID int64, messageID int) error {
+	_, err := s.db.Exec(
+		"UPDATE messages SET replies = replies + 1 WHERE chat_id = ? AND id = ?",
+		chatID, messageID,
+	)
+	return err
+}
+
+func (s sqliteMessageStore) MarkRecalled(chatID int64, messageID int, at time.Time) error {
+	_, err := s.db.Exec(
+		"UPDATE messages SET recalled = recalled + 1, recalled_at = ? WHERE chat_id = ? AND id = ?",
+		at.Unix(), chatID, messageID,
+	)
+	return err
+}
+
+func (s sqliteMessageStore) Query(chatID int64, q MessageQuery) (refs []MessageRef, err error) {
+	where := []string{"chat_id = ?"}
+	args := []interface{}{chatID}
+	if q.AuthorID != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, q.AuthorID)
+	}
+	if q.Author != "" {
+		where = append(where, "author = ? COLLATE NOCASE")
+		args = append(args, q.author())
+	}
+	if q.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, q.Type)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "date >= ?")
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "date < ?")
+		args = append(args, q.Until.Unix())
+	}
+
+	rows, err := s.db.Query(
+		"SELECT "+messageColumns+" FROM messages WHERE "+strings.Join(where, " AND ")+" ORDER BY rowid",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ref MessageRef
+		var fileIDs sql.NullString
+		err = rows.Scan(
+			&ref.ID, &ref.AuthorID, &ref.Author, &ref.AuthorName, &ref.Date, &ref.Type, &ref.Text,
+			&fileIDs, &ref.ReplyToID, &ref.Replies, &ref.Recalled, &ref.RecalledAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if fileIDs.Valid {
+			if err = json.Unmarshal([]byte(fileIDs.String), &ref.FileIDs); err != nil {
+				Log.Error("Can't decode file ids", "chat_id", chatID, "error", err)
+			}
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+func (s sqliteMessageStore) IDs() ([]int64, error) {
+	return s.ids("SELECT DISTINCT chat_id FROM messages ORDER BY chat_id")
+}
+
+func (s sqliteMessageStore) Counts() (map[int64]int, error) {
+	rows, err := s.db.Query("SELECT chat_id, COUNT(*) FROM messages GROUP BY chat_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var n int
+		if err = rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+func (s sqliteMessageStore) Delete(chatID int64) error {
+	_, err := s.db.Exec("DELETE FROM messages WHERE chat_id = ?", chatID)
+	return err
+}
+
+// Migrate has nothing to upgrade, there are no legacy SQLite databases.
+func (s sqliteMessageStore) Migrate() (int, error) {
+	return 0, nil
+}
+
+func insertMessage(tx *sql.Tx, chatID int64, ref MessageRef) error {
+	var fileIDs sql.NullString
+	if len(ref.FileIDs) > 0 {
+		data, err := json.Marshal(ref.FileIDs)
+		if err != nil {
+			return err
+		}
+		fileIDs = sql.NullString{String: string(data), Valid: true}
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO messages (chat_id, "+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chatID, ref.ID, ref.AuthorID, ref.Author, ref.AuthorName, ref.Date, ref.Type, ref.Text,
+		fileIDs, ref.ReplyToID, ref.Replies, ref.Recalled, ref.RecalledAt,
+	)
+	return err
+}
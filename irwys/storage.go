@@ -0,0 +1,244 @@
+package irwys
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ChatStore keeps configuration of chats the bot is started in.
+type ChatStore interface {
+	// Get returns configuration of the chat and whether it exists.
+	Get(chatID int64) (conf ChatConfig, ok bool, err error)
+	// Put saves configuration of the chat.
+	Put(chatID int64, conf ChatConfig) error
+	// Update changes configuration of an existing chat with fn.
+	// Nothing is saved if the chat doesn't exist or fn fails.
+	Update(chatID int64, fn func(conf *ChatConfig) error) error
+	// Delete removes configuration of the chat.
+	Delete(chatID int64) error
+	// Exist checks if the chat has configuration.
+	Exist(chatID int64) (bool, error)
+	// IDs returns identifiers of all known chats.
+	IDs() ([]int64, error)
+	// Migrate upgrades records written in a legacy format and returns their number.
+	Migrate() (int, error)
+}
+
+// MessageStore keeps remembered messages per chat.
+type MessageStore interface {
+	// Get returns remembered messages of the chat, oldest first.
+	Get(chatID int64) ([]MessageRef, error)
+	// Put replaces remembered messages of the chat.
+	Put(chatID int64, refs []MessageRef) error
+	// Append remembers a message of the chat,
+	// dropping the oldest ones to keep no more than capacity messages.
+	Append(chatID int64, ref MessageRef, capacity int) error
+	// Remove forgets a message of the chat.
+	Remove(chatID int64, messageID int) error
+	// CountReply accounts a reply to a remembered message of the chat.
+	CountReply(chatID int64, messageID int) error
+	// MarkRecalled accounts a recall of a remembered message of the chat.
+	MarkRecalled(chatID int64, messageID int, at time.Time) error
+	// Query returns remembered messages of the chat matching q, oldest first.
+	Query(chatID int64, q MessageQuery) ([]MessageRef, error)
+	// IDs returns identifiers of chats with remembered messages.
+	IDs() ([]int64, error)
+	// Counts returns numbers of remembered messages per chat.
+	Counts() (map[int64]int, error)
+	// Delete forgets all messages of the chat.
+	Delete(chatID int64) error
+	// Migrate upgrades records written in a legacy format and returns their number.
+	Migrate() (int, error)
+}
+
+// Store is a storage backend keeping everything the bot remembers.
+type Store interface {
+	Messages() MessageStore
+	Chats() ChatStore
+	// Close releases the backend.
+	Close()
+}
+
+// StoreStat is a figure describing a storage backend.
+type StoreStat struct {
+	Name  string
+	Value int64
+}
+
+// compacter is implemented by backends able to reclaim space of deleted records.
+type compacter interface {
+	Compact() error
+}
+
+// statter is implemented by backends reporting figures about their databases.
+type statter interface {
+	Stats() ([]StoreStat, error)
+}
+
+// MessageQuery selects remembered messages. Zero fields match any message.
+type MessageQuery struct {
+	AuthorID int
+	// Author is a username, with or without the leading @, matched case-insensitively.
+	Author string
+	Type   string
+	// Since and Until limit the date the message was posted, Until is exclusive.
+	Since time.Time
+	Until time.Time
+}
+
+func (q MessageQuery) author() string {
+	return strings.ToLower(strings.TrimPrefix(q.Author, "@"))
+}
+
+// match checks if the message is selected by the query.
+func (q MessageQuery) match(ref MessageRef) bool {
+	if q.AuthorID != 0 && ref.AuthorID != q.AuthorID {
+		return false
+	}
+	if q.Author != "" && strings.ToLower(ref.Author) != q.author() {
+		return false
+	}
+	if q.Type != "" && ref.Type != q.Type {
+		return false
+	}
+	if !q.Since.IsZero() && ref.Date < q.Since.Unix() {
+		return false
+	}
+	if !q.Until.IsZero() && ref.Date >= q.Until.Unix() {
+		return false
+	}
+	return true
+}
+
+func (q MessageQuery) filter(refs []MessageRef) []MessageRef {
+	matched := []MessageRef{}
+	for _, ref := range refs {
+		if q.match(ref) {
+			matched = append(matched, ref)
+		}
+	}
+	return matched
+}
+
+// Storage backends selectable by name.
+const (
+	LevelStorage  = "leveldb"
+	SQLiteStorage = "sqlite"
+	MemoryStorage = "memory"
+)
+
+// StorageNames lists storage backends selectable by name.
+var StorageNames = []string{LevelStorage, SQLiteStorage, MemoryStorage}
+
+// OpenStore opens the named storage backend keeping its files under path.
+func OpenStore(backend string, path string) (Store, error) {
+	switch backend {
+	case LevelStorage, "":
+		o := &opt.Options{
+			BlockCacheCapacity: 128 * opt.MiB,
+			WriteBuffer:        16 * opt.MiB,
+		}
+		return NewLevelStore(path, o), nil
+	case SQLiteStorage:
+		return NewSQLiteStore(path)
+	case MemoryStorage:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", backend)
+}
+
+// Open opens the storage configured by options, upgrading records written in legacy formats.
+func (o *Options) Open() (Store, error) {
+	store, err := OpenStore(o.Storage, o.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := store.Messages().Migrate(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("can't migrate messages: %s", err)
+	} else if n > 0 {
+		Log.Info("Migrated messages database", "records", n)
+	}
+	if n, err := store.Chats().Migrate(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("can't migrate chats: %s", err)
+	} else if n > 0 {
+		Log.Info("Migrated chats database", "records", n)
+	}
+
+	return store, nil
+}
+
+// levelStore structure.
+// Implements Store with a LevelDB database for messages and another one for chats.
+type levelStore struct {
+	messages levelMessageStore
+	chats    levelChatStore
+}
+
+// NewLevelStore creates a Store kept in the messages and chats LevelDB databases under path.
+func NewLevelStore(path string, opts *opt.Options) Store {
+	return levelStore{
+		NewMessageStore(NewDB(path, "messages", opts)).(levelMessageStore),
+		NewChatStore(NewDB(path, "chats", opts)).(levelChatStore),
+	}
+}
+
+// NewMemoryStore creates a Store kept in memory, which is lost once closed.
+func NewMemoryStore() Store {
+	return levelStore{
+		NewMessageStore(NewMemDB()).(levelMessageStore),
+		NewChatStore(NewMemDB()).(levelChatStore),
+	}
+}
+
+func (s levelStore) Messages() MessageStore {
+	return s.messages
+}
+
+func (s levelStore) Chats() ChatStore {
+	return s.chats
+}
+
+func (s levelStore) Compact() error {
+	if err := s.messages.db.Compact(); err != nil {
+		return err
+	}
+	return s.chats.db.Compact()
+}
+
+func (s levelStore) Stats() ([]StoreStat, error) {
+	stats := []StoreStat{}
+	for _, db := range []struct {
+		name string
+		db   DB
+	}{{"messages", s.messages.db}, {"chats", s.chats.db}} {
+		st, err := db.db.Stats()
+		if err != nil {
+			return nil, err
+		}
+		var size, tables int64
+		for i := range st.LevelSizes {
+			size += st.LevelSizes[i]
+			tables += int64(st.LevelTablesCounts[i])
+		}
+		stats = append(stats,
+			StoreStat{db.name + "_size_bytes", size},
+			StoreStat{db.name + "_tables", tables},
+			StoreStat{db.name + "_read_bytes", int64(st.IORead)},
+			StoreStat{db.name + "_written_bytes", int64(st.IOWrite)},
+			StoreStat{db.name + "_block_cache_bytes", int64(st.BlockCacheSize)},
+			StoreStat{db.name + "_write_delays", int64(st.WriteDelayCount)},
+		)
+	}
+	return stats, nil
+}
+
+func (s levelStore) Close() {
+	s.messages.Close()
+	s.chats.Close()
+}
@@ -0,0 +1,216 @@
+package irwys
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ids(refs []MessageRef) []int {
+	ids := []int{}
+	for _, ref := range refs {
+		ids = append(ids, ref.ID)
+	}
+	return ids
+}
+
+func forEachStorage(t *testing.T, test func(t *testing.T, store Store)) {
+
+	for _, backend := range StorageNames {
+		t.Run(backend, func(t *testing.T) {
+			store, err := OpenStore(backend, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			test(t, store)
+		})
+	}
+}
+
+func TestStoreChats(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Store) {
+		chats := store.Chats()
+
+		if _, ok, err := chats.Get(-1); ok || err != nil {
+			t.Fatalf("Got missing chat (%v)", err)
+		}
+		if err := chats.Update(-1, func(conf *ChatConfig) error { conf.Language = "ru"; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := chats.Exist(-1); ok {
+			t.Fatal("Update created a missing chat")
+		}
+
+		for _, id := range []int64{-2, 5} {
+			if err := chats.Put(id, ChatConfig{Language: "en"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := chats.Update(5, func(conf *ChatConfig) error {
+			conf.Settings = map[string]int{"timeout": 10}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf, ok, err := chats.Get(5)
+		want := ChatConfig{Language: "en", Settings: map[string]int{"timeout": 10}}
+		if !ok || err != nil || !reflect.DeepEqual(conf, want) {
+			t.Fatalf("Got %+v (%v), want %+v", conf, err, want)
+		}
+
+		if err := chats.Delete(-2); err != nil {
+			t.Fatal(err)
+		}
+		if ids, err := chats.IDs(); err != nil || !reflect.DeepEqual(ids, []int64{5}) {
+			t.Fatalf("Got chats %v (%v), want [5]", ids, err)
+		}
+	})
+}
+
+func TestStoreDeleteWaitsForUpdate(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Store) {
+		chats := store.Chats()
+		if err := chats.Put(7, ChatConfig{Language: "en"}); err != nil {
+			t.Fatal(err)
+		}
+
+		deleted := make(chan error, 1)
+		err := chats.Update(7, func(conf *ChatConfig) error {
+			go func() { deleted <- chats.Delete(7) }()
+			select {
+			case <-deleted:
+				t.Error("Chat deleted while it's updated")
+			case <-time.After(50 * time.Millisecond):
+			}
+			conf.Language = "ru"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = <-deleted; err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := chats.Exist(7); ok {
+			t.Fatal("Update brought a deleted chat back")
+		}
+	})
+}
+
+func TestStoreMessageCounts(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Store) {
+		messages := store.Messages()
+		for i := 1; i <= 3; i++ {
+			if err := messages.Append(-1, MessageRef{ID: i}, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := messages.Append(-2, MessageRef{ID: 1}, 2); err != nil {
+			t.Fatal(err)
+		}
+		check := func(want map[int64]int) {
+			t.Helper()
+			if counts, err := messages.Counts(); err != nil || !reflect.DeepEqual(counts, want) {
+				t.Fatalf("Got counts %v (%v), want %v", counts, err, want)
+			}
+		}
+		check(map[int64]int{-1: 2, -2: 1})
+
+		// Counts keep up with writes once read.
+		if err := messages.Remove(-1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := messages.Delete(-2); err != nil {
+			t.Fatal(err)
+		}
+		if err := messages.Append(5, MessageRef{ID: 1}, 2); err != nil {
+			t.Fatal(err)
+		}
+		check(map[int64]int{-1: 1, 5: 1})
+	})
+}
+
+func TestStoreMessages(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Store) {
+		messages := store.Messages()
+		day := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+		for i := 1; i <= 5; i++ {
+			ref := MessageRef{
+				ID:       i,
+				AuthorID: 10 + i%2,
+				Author:   []string{"Even", "odd"}[i%2],
+				Date:     day.AddDate(0, 0, i).Unix(),
+				Type:     messageText,
+				Text:     "message",
+			}
+			if i == 4 {
+				ref.Type = messagePhoto
+				ref.FileIDs = []string{"small", "large"}
+			}
+			if err := messages.Append(-1, ref, 4); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := messages.Append(-2, MessageRef{ID: 1}, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		refs, err := messages.Get(-1)
+		if err != nil || !reflect.DeepEqual(ids(refs), []int{2, 3, 4, 5}) {
+			t.Fatalf("Got messages %v (%v), want [2 3 4 5]", ids(refs), err)
+		}
+		if !reflect.DeepEqual(refs[2].FileIDs, []string{"small", "large"}) {
+			t.Fatalf("Got file ids %v", refs[2].FileIDs)
+		}
+
+		messages.CountReply(-1, 3)
+		messages.MarkRecalled(-1, 3, day)
+		messages.Remove(-1, 2)
+		refs, _ = messages.Get(-1)
+		if !reflect.DeepEqual(ids(refs), []int{3, 4, 5}) {
+			t.Fatalf("Got messages %v, want [3 4 5]", ids(refs))
+		}
+		if refs[0].Replies != 1 || refs[0].Recalled != 1 || refs[0].RecalledAt != day.Unix() {
+			t.Fatalf("Counters weren't updated: %+v", refs[0])
+		}
+
+		queries := []struct {
+			q    MessageQuery
+			want []int
+		}{
+			{MessageQuery{}, []int{3, 4, 5}},
+			{MessageQuery{AuthorID: 11}, []int{3, 5}},
+			{MessageQuery{Author: "@EVEN"}, []int{4}},
+			{MessageQuery{Type: messagePhoto}, []int{4}},
+			{MessageQuery{Since: day.AddDate(0, 0, 4)}, []int{4, 5}},
+			{MessageQuery{Until: day.AddDate(0, 0, 4)}, []int{3}},
+			{MessageQuery{AuthorID: 11, Since: day.AddDate(0, 0, 4)}, []int{5}},
+		}
+		for _, c := range queries {
+			refs, err := messages.Query(-1, c.q)
+			if err != nil || !reflect.DeepEqual(ids(refs), c.want) {
+				t.Errorf("Query %+v got %v (%v), want %v", c.q, ids(refs), err, c.want)
+			}
+		}
+
+		if err := messages.Put(-1, []MessageRef{{ID: 9}, {ID: 7}}); err != nil {
+			t.Fatal(err)
+		}
+		if refs, _ := messages.Get(-1); !reflect.DeepEqual(ids(refs), []int{9, 7}) {
+			t.Fatalf("Got messages %v after put, want [9 7]", ids(refs))
+		}
+		messages.Delete(-1)
+		if refs, _ := messages.Get(-1); len(refs) != 0 {
+			t.Fatalf("Got messages %v after delete", ids(refs))
+		}
+		if refs, _ := messages.Get(-2); !reflect.DeepEqual(ids(refs), []int{1}) {
+			t.Fatalf("Other chat got messages %v, want [1]", ids(refs))
+		}
+		if chats, err := messages.IDs(); err != nil || !reflect.DeepEqual(chats, []int64{-2}) {
+			t.Fatalf("Got chats with messages %v (%v), want [-2]", chats, err)
+		}
+	})
+}
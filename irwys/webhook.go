@@ -0,0 +1,203 @@
+package irwys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// secretTokenHeader is the header Telegram puts the webhook secret token in.
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookShutdownTimeout limits the time requests in progress are waited for on shutdown.
+const webhookShutdownTimeout = 5 * time.Second
+
+// maxUpdateSize limits the size of an update accepted by the webhook.
+const maxUpdateSize = 1 << 20
+
+// webhookHandler structure.
+// Accepts updates POSTed by Telegram to the secret path,
+// provided they carry the secret token, and delivers them to the channel.
+type webhookHandler struct {
+	path    string
+	secret  string
+	updates chan tgbotapi.Update
+	// done is closed once updates aren't received anymore.
+	done <-chan struct{}
+	// contact is touched on every accepted update.
+	contact *contact
+}
+
+// newWebhookHandler creates an object of webhookHandler structure.
+func newWebhookHandler(path string, secret string) *webhookHandler {
+	if path == "" {
+		path = "/"
+	}
+	h := webhookHandler{
+		path:    path,
+		secret:  secret,
+		updates: make(chan tgbotapi.Update, 100),
+		contact: &contact{},
+	}
+	return &h
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get(secretTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.secret)) != 1 {
+		Log.Warn("Rejected webhook request with wrong secret token", "remote", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var update tgbotapi.Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateSize)).Decode(&update); err != nil {
+		Log.Error("Can't decode webhook update", "error", err)
+		http.Error(w, "bad update", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.updates <- update:
+		h.contact.touch()
+		w.WriteHeader(http.StatusOK)
+	case <-h.done:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+// webhookMessenger structure.
+// Implements Messenger on top of the Telegram Bot API,
+// receiving updates through a webhook instead of long polling.
+type webhookMessenger struct {
+	telegramMessenger
+	url     *url.URL
+	listen  string
+	secret  string
+	tlsCert string
+	tlsKey  string
+}
+
+// NewWebhookMessenger creates a Messenger authenticated with the given token,
+// that registers hookURL as the webhook and serves it on the listen address.
+// The listener only accepts updates POSTed to the path of hookURL with the secret token;
+// a random token is generated if secret is empty.
+// Unless tlsCert and tlsKey are given, plain HTTP is served, e.g. behind a TLS terminating proxy.
+func NewWebhookMessenger(
+	token string,
+	hookURL string,
+	listen string,
+	secret string,
+	tlsCert string,
+	tlsKey string,
+) (Messenger, error) {
+	u, err := url.Parse(hookURL)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		if secret, err = randomSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	api, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	return webhookMessenger{telegramMessenger{api, &contact{}}, u, listen, secret, tlsCert, tlsKey}, nil
+}
+
+// Updates registers the webhook and starts serving it until ctx is done.
+func (m webhookMessenger) Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	ln, err := net.Listen("tcp", m.listen)
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{}
+	v.Add("url", m.url.String())
+	v.Add("secret_token", m.secret)
+	if _, err := m.api.MakeRequest("setWebhook", v); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	m.contact.touch()
+	go m.watch(ctx)
+
+	h := newWebhookHandler(m.url.Path, m.secret)
+	h.done = ctx.Done()
+	h.contact = m.contact
+	srv := &http.Server{Handler: h}
+	go func() {
+		var err error
+		if m.tlsCert != "" && m.tlsKey != "" {
+			err = srv.ServeTLS(ln, m.tlsCert, m.tlsKey)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			Log.Error("Webhook listener stopped", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			Log.Error("Can't stop webhook listener", "error", err)
+		}
+	}()
+
+	Log.Info("Listening for webhook updates", "address", ln.Addr(), "path", h.path)
+	return h.updates, nil
+}
+
+// watch checks the webhook is still set every pollTimeout until ctx is done,
+// touching the contact so that quiet chats don't make Telegram look unreachable.
+func (m webhookMessenger) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := m.api.GetWebhookInfo()
+		switch {
+		case err != nil:
+			Log.Warn("Can't check webhook", "error", err)
+		case info.URL != m.url.String():
+			Log.Warn("Webhook isn't set anymore", "url", info.URL)
+		default:
+			m.contact.touch()
+		}
+	}
+}
+
+// randomSecret returns a secret token suitable for setWebhook.
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,107 @@
+package irwys
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/Syfaro/telegram-bot-api"
+)
+
+// hookedMessenger sends through the fake, but receives updates from the webhook handler.
+type hookedMessenger struct {
+	*FakeMessenger
+	hook *webhookHandler
+}
+
+func (m hookedMessenger) Updates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	return m.hook.updates, nil
+}
+
+const recordedStart = `{
+	"update_id": 100,
+	"message": {
+		"message_id": 7,
+		"from": {"id": 42, "first_name": "Test", "username": "tester"},
+		"chat": {"id": 1012, "type": "group", "title": "Webhook"},
+		"date": 1500000000,
+		"text": "/start",
+		"entities": [{"type": "bot_command", "offset": 0, "length": 6}]
+	}
+}`
+
+func postUpdate(t *testing.T, srv *httptest.Server, path string, secret string, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(secretTokenHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebhookRejectsUnauthorizedRequests(t *testing.T) {
+	hook := newWebhookHandler("/hook/s3cr3t", "token")
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	cases := []struct {
+		name   string
+		path   string
+		secret string
+		body   string
+		status int
+	}{
+		{"wrong path", "/hook/guess", "token", recordedStart, http.StatusNotFound},
+		{"no secret", "/hook/s3cr3t", "", recordedStart, http.StatusForbidden},
+		{"wrong secret", "/hook/s3cr3t", "tokem", recordedStart, http.StatusForbidden},
+		{"malformed update", "/hook/s3cr3t", "token", "{", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if status := postUpdate(t, srv, c.path, c.secret, c.body); status != c.status {
+			t.Errorf("%s: got status %d, want %d", c.name, status, c.status)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/hook/s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	if len(hook.updates) != 0 {
+		t.Fatalf("%d rejected updates were delivered", len(hook.updates))
+	}
+}
+
+func TestWebhookDispatchesRecordedUpdate(t *testing.T) {
+	fake := NewFakeMessenger(tgbotapi.User{ID: 1, UserName: "irwys_bot", IsBot: true})
+	hook := newWebhookHandler("/hook/s3cr3t", "token")
+	env := startTestEnv(t, fake, hookedMessenger{fake, hook})
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	if status := postUpdate(t, srv, "/hook/s3cr3t", "token", recordedStart); status != http.StatusOK {
+		t.Fatalf("Got status %d", status)
+	}
+
+	msg := env.expectSent(t)
+	if msg.Chat.ID != 1012 || !strings.Contains(msg.Text, "I Remember What You Said bot") {
+		t.Fatalf("Unexpected welcome message: %+v", msg)
+	}
+	chat := &tgbotapi.Chat{ID: 1012}
+	env.waitFor(t, "default language", func() bool { return env.language(chat) == "en" })
+}
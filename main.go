@@ -1,9 +1,13 @@
+// Command irwys runs the I Remember What You Said Telegram bot and maintains its storage.
+// It needs Go 1.21 or newer to build, for log/slog.
 package main
 
 import (
 	"fmt"
 	"math"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/FromZeus/irwys/irwys"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -20,53 +24,365 @@ var (
 	).Default(strconv.FormatUint(math.MaxUint16, 10)).Uint16()
 	timeout = kingpin.Flag(
 		"timeout",
-		`How long to wait after last message was posted (in minutes).
-		There is 30% chance of reply.`,
+		"How long to wait after last message was posted (in minutes).",
 	).Default("30").Short('t').Int16()
 	timeStart = kingpin.Flag(
 		"timeStart",
-		"When bot starts to recall.",
+		"When bot starts to recall (hour in the chat's time zone). May be greater than timeEnd to wrap past midnight.",
 	).Default("9").Uint8()
 	timeEnd = kingpin.Flag(
 		"timeEnd",
-		"When bot ends to recall.",
+		"When bot ends to recall (hour in the chat's time zone).",
 	).Default("23").Uint8()
 	capacity = kingpin.Flag(
 		"capacity",
 		"Capacity of message storage per chat (in messages).",
 	).Default("2048").Short('c').Uint16()
+	probability = kingpin.Flag(
+		"probability",
+		"Chance of recall once the chat has been silent for timeout (in percent).",
+	).Default("30").Uint8()
+	minInterval = kingpin.Flag(
+		"minInterval",
+		"Minimal interval between recalls (in minutes).",
+	).Default("0").Uint16()
+	maxPerDay = kingpin.Flag(
+		"maxPerDay",
+		"Maximal number of recalls per day. 0 means unlimited.",
+	).Default("0").Uint16()
+	jitter = kingpin.Flag(
+		"jitter",
+		"Maximal random delay added to recall time (in minutes).",
+	).Default("0").Uint16()
+	strategy = kingpin.Flag(
+		"strategy",
+		"How messages to recall are picked: uniform, older, popular or anniversary.",
+	).Default("uniform").Enum("uniform", "older", "popular", "anniversary")
+	noRepeat = kingpin.Flag(
+		"noRepeat",
+		"How many last recalled messages not to recall again.",
+	).Default("0").Uint16()
+	storage = kingpin.Flag(
+		"storage",
+		"Storage backend: leveldb, sqlite or memory (forgets everything on exit).",
+	).Default(irwys.LevelStorage).Enum(irwys.StorageNames...)
 	dbPath = kingpin.Flag(
 		"dbPath",
-		"Path to level db.",
+		"Path to the database directory.",
 	).Default("./db").Short('d').String()
 	replyPath = kingpin.Flag(
 		"replyPath",
 		"Path to reply dictionaries.",
 	).Default("./replies").Short('r').String()
+	language = kingpin.Flag(
+		"language",
+		"Default language of chats, used wherever a chat's language has no replies. "+
+			"Its dictionary must be in replyPath.",
+	).Default("en").String()
+	webhook = kingpin.Flag(
+		"webhook",
+		"Public URL to receive updates through a webhook instead of long polling. Its path should be hard to guess.",
+	).String()
+	listen = kingpin.Flag(
+		"listen",
+		"Address the webhook listener binds to.",
+	).Default(":8443").String()
+	webhookSecret = kingpin.Flag(
+		"webhookSecret",
+		"Secret token Telegram sends with webhook updates. Random if not set.",
+	).String()
+	tlsCert = kingpin.Flag(
+		"tlsCert",
+		"TLS certificate of the webhook listener. Plain HTTP is served if not set.",
+	).String()
+	tlsKey = kingpin.Flag(
+		"tlsKey",
+		"TLS key of the webhook listener.",
+	).String()
+	adminListen = kingpin.Flag(
+		"adminListen",
+		"Address of the admin HTTP server exposing /metrics. Not served if not set.",
+	).String()
+	health = kingpin.Flag(
+		"health",
+		"Serve /healthz and /readyz on the admin HTTP server.",
+	).Bool()
 	verbose = kingpin.Flag(
 		"verbose",
-		"Verbose logging mode.",
+		"Verbose logging mode, same as --logLevel=debug.",
 	).Short('v').Bool()
-	token = kingpin.Arg(
+	logLevel = kingpin.Flag(
+		"logLevel",
+		"Lowest level of logged events.",
+	).Default("info").Enum(irwys.LogLevels...)
+	logFormat = kingpin.Flag(
+		"logFormat",
+		"Format of logs: text (logfmt) or json.",
+	).Default(irwys.TextLog).Enum(irwys.LogFormats...)
+	redact = kingpin.Flag(
+		"redact",
+		"Leave text of messages out of logs.",
+	).Bool()
+
+	config = kingpin.Flag(
+		configFlag,
+		"YAML or TOML (.toml) file with values of flags, keyed by flag names, and the token. "+
+			"Flags are also read from environment variables like "+envName("minWords")+". "+
+			"Flags override environment variables, which override the file. "+
+			"The running bot reads the file, the environment and reply dictionaries again on SIGHUP, "+
+			"though logging flags and ones of storage, webhook and admin server only change on restart.",
+	).String()
+	tokenFile = kingpin.Flag(
+		"tokenFile",
+		"File containing bot's token, if it's given neither as the argument nor in the config file.",
+	).String()
+
+	runCmd   = kingpin.Command("run", "Run the bot (default).").Default()
+	tokenArg = runCmd.Arg(
 		"token",
-		"Bot's token.",
+		"Bot's token. Better given by the "+envName(tokenKey)+" environment variable or in a file.",
+	)
+	token = tokenArg.String()
+
+	exportCmd = kingpin.Command(
+		"export",
+		"Export configuration and remembered messages of a chat as JSON lines.",
+	)
+	exportChat = exportCmd.Flag(
+		"chat",
+		"Chat to export. Negative ids are given as --chat=-100123.",
+	).Required().Int64()
+	exportOutput = exportCmd.Flag(
+		"output",
+		"File to write to instead of standard output.",
+	).Short('o').String()
+
+	importCmd = kingpin.Command(
+		"import",
+		"Import chats exported as JSON lines, or a chat history exported by Telegram Desktop.",
+	)
+	importTelegram = importCmd.Flag(
+		"telegram",
+		"The file is result.json exported by Telegram Desktop.",
+	).Bool()
+	importChat = importCmd.Flag(
+		"chat",
+		"Chat to import Telegram Desktop history into. Defaults to the exported chat.",
+	).Int64()
+	importFile = importCmd.Arg(
+		"file",
+		"File to import. Standard input if not set.",
+	).ExistingFile()
+
+	chatsCmd     = kingpin.Command("chats", "Inspect chats the bot is started in.")
+	chatsListCmd = chatsCmd.Command("list", "List chats.")
+	chatsShowCmd = chatsCmd.Command("show", "Show details and settings of a chat.")
+	chatsShowID  = chatsShowCmd.Arg(
+		"id",
+		"Chat to show. Negative ids are given after --, e.g. show -- -100123.",
+	).Required().Int64()
+
+	messagesCmd      = kingpin.Command("messages", "Maintain remembered messages.")
+	messagesPurgeCmd = messagesCmd.Command("purge", "Forget messages of a chat posted before a date.")
+	purgeChat        = messagesPurgeCmd.Flag(
+		"chat",
+		"Chat to purge. Negative ids are given as --chat=-100123.",
+	).Required().Int64()
+	purgeBefore = messagesPurgeCmd.Flag(
+		"before",
+		"Date as 2006-01-02 (local time) or RFC 3339 timestamp.",
 	).Required().String()
+
+	dbCmd        = kingpin.Command("db", "Maintain the database.")
+	dbCompactCmd = dbCmd.Command("compact", "Reclaim space of deleted records.")
+	dbStatsCmd   = dbCmd.Command("stats", "Show database statistics.")
 )
 
 func main() {
-	kingpin.Parse()
-	opts := irwys.NewOptions(
-		*minWords,
-		*maxWords,
-		*timeout,
-		*timeStart,
-		*timeEnd,
-		*capacity,
-		*dbPath,
-		*replyPath,
-		*verbose,
-	)
+	defaults := flagDefaults(kingpin.CommandLine)
+	if path := configPath(os.Args[1:]); path != "" {
+		values, err := loadConfig(path)
+		if err != nil {
+			kingpin.Fatalf("Can't load config: %s", err)
+		}
+		if err = configure(kingpin.CommandLine, tokenArg, values); err != nil {
+			kingpin.Fatalf("Invalid config %s: %s", path, err)
+		}
+	} else if err := configure(kingpin.CommandLine, tokenArg, nil); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+
+	command := kingpin.Parse()
+	opts := options()
+	if err := opts.Validate(); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	format, level, redacted := logging()
+	if err := irwys.Init(os.Stderr, format, level, redacted); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+
+	switch command {
+	case runCmd.FullCommand():
+		if *token == "" && *tokenFile != "" {
+			t, err := readToken(*tokenFile)
+			if err != nil {
+				kingpin.Fatalf("Can't read token: %s", err)
+			}
+			*token = t
+		}
+		if *token == "" {
+			kingpin.Fatalf("Bot's token is required")
+		}
+		bot := irwys.New(*token, &opts)
+		bot.ReloadOptions(func() (irwys.Options, error) {
+			args := os.Args[1:]
+			if err := reconfigure(kingpin.CommandLine, tokenArg, defaults, configPath(args), args); err != nil {
+				return irwys.Options{}, err
+			}
+			if f, l, r := logging(); f != format || l != level || r != redacted {
+				irwys.Log.Warn("Logging can't change until restart")
+			}
+			return options(), nil
+		})
+		bot.Start()
+	case exportCmd.FullCommand():
+		withStore(&opts, func(store irwys.Store) error {
+			return export(store)
+		})
+	case importCmd.FullCommand():
+		withStore(&opts, func(store irwys.Store) error {
+			return importChats(store, &opts)
+		})
+	case chatsListCmd.FullCommand():
+		withStore(&opts, func(store irwys.Store) error {
+			return irwys.WriteChats(store, os.Stdout)
+		})
+	case chatsShowCmd.FullCommand():
+		withStore(&opts, func(store irwys.Store) error {
+			return irwys.WriteChat(store, *chatsShowID, &opts, os.Stdout)
+		})
+	case messagesPurgeCmd.FullCommand():
+		withStore(&opts, purge)
+	case dbCompactCmd.FullCommand():
+		withStore(&opts, irwys.Compact)
+	case dbStatsCmd.FullCommand():
+		withStore(&opts, func(store irwys.Store) error {
+			return irwys.WriteStats(store, os.Stdout)
+		})
+	}
+}
+
+// options returns options given by flags.
+func options() irwys.Options {
+	return irwys.Options{
+		MinWords:    *minWords,
+		MaxWords:    *maxWords,
+		Timeout:     *timeout,
+		TimeStart:   *timeStart,
+		TimeEnd:     *timeEnd,
+		Capacity:    *capacity,
+		Probability: *probability,
+		MinInterval: *minInterval,
+		MaxPerDay:   *maxPerDay,
+		Jitter:      *jitter,
+		Strategy:    *strategy,
+		NoRepeat:    *noRepeat,
+		Storage:     *storage,
+		DBPath:      *dbPath,
+		ReplyPath:   *replyPath,
+		Webhook:     *webhook,
+		Listen:      *listen,
+		Secret:      *webhookSecret,
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+		AdminListen: *adminListen,
+		Health:      *health,
+		Language:    *language,
+	}
+}
+
+// logging returns the format, the level and redaction of logs given by flags.
+func logging() (string, string, bool) {
+	level := *logLevel
+	if *verbose {
+		level = "debug"
+	}
+	return *logFormat, level, *redact
+}
+
+// withStore runs a maintenance command on the storage, exiting on failure.
+func withStore(opts *irwys.Options, fn func(store irwys.Store) error) {
+	store, err := opts.Open()
+	if err != nil {
+		kingpin.Fatalf("Can't open storage: %s", err)
+	}
+	err = fn(store)
+	store.Close()
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+}
+
+func export(store irwys.Store) error {
+	w := os.Stdout
+	if *exportOutput != "" {
+		f, err := os.Create(*exportOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := irwys.Export(store, *exportChat, w)
+	if err != nil {
+		return err
+	}
+	irwys.Log.Info("Exported chat", "chat_id", *exportChat, "messages", n)
+	return nil
+}
+
+func purge(store irwys.Store) error {
+	before, err := time.ParseInLocation("2006-01-02", *purgeBefore, time.Local)
+	if err != nil {
+		if before, err = time.Parse(time.RFC3339, *purgeBefore); err != nil {
+			return fmt.Errorf("can't parse date %q", *purgeBefore)
+		}
+	}
+
+	n, err := irwys.Purge(store, *purgeChat, before)
+	if err != nil {
+		return err
+	}
+	irwys.Log.Info("Purged messages", "chat_id", *purgeChat, "messages", n)
+	return nil
+}
+
+func importChats(store irwys.Store, opts *irwys.Options) error {
+	r := os.Stdin
+	if *importFile != "" {
+		f, err := os.Open(*importFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if *importTelegram {
+		chatID, n, err := irwys.ImportTelegram(store, r, *importChat, opts)
+		if err != nil {
+			return err
+		}
+		irwys.Log.Info("Imported Telegram history", "chat_id", chatID, "messages", n)
+		return nil
+	}
 
-	bot := irwys.New(*token, &opts)
-	bot.Start()
+	n, err := irwys.Import(store, r, opts)
+	if err != nil {
+		return err
+	}
+	irwys.Log.Info("Imported chats", "messages", n)
+	return nil
 }